@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi/config"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/jpeach/pulumi-stacks/pkg/cloudinit"
+	"github.com/jpeach/pulumi-stacks/pkg/keys"
+)
+
+const SSHCAKeyPath = "./ssh/ca.pem"
+const SSHCertificatesPath = "./ssh/certs"
+
+// CAOptions configures the SSH certificate authority.
+type CAOptions struct {
+	// Enabled is true if hosts should trust the CA.
+	Enabled bool
+	// Key is the PEM-encoded CA private key. If it is empty, the
+	// key is read from SSHCAKeyPath.
+	Key string
+	// Principals are the login users that certificates are valid for.
+	// The default is the login user for the image.
+	Principals []string
+	// Validity is how long certificates are valid for.
+	Validity time.Duration
+	// Certificates maps a teammate's name to the public key to issue
+	// them a certificate for.
+	Certificates map[string]string
+}
+
+// NewCAOptions reads the CA options from the "ssh" config namespace.
+func NewCAOptions(ctx *pulumi.Context, image *Image) (*CAOptions, error) {
+	sshOpts := config.New(ctx, "ssh")
+
+	opts := &CAOptions{
+		Enabled:    sshOpts.GetBool("ca"),
+		Key:        sshOpts.Get("caKey"),
+		Principals: []string{image.User},
+		Validity:   24 * time.Hour,
+	}
+
+	if v := sshOpts.Get("certificateValidity"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ssh:certificateValidity: %w", err)
+		}
+
+		opts.Validity = d
+	}
+
+	if err := sshOpts.GetObject("principals", &opts.Principals); err != nil {
+		return nil, fmt.Errorf("invalid ssh:principals: %w", err)
+	}
+
+	if err := sshOpts.GetObject("certificates", &opts.Certificates); err != nil {
+		return nil, fmt.Errorf("invalid ssh:certificates: %w", err)
+	}
+
+	return opts, nil
+}
+
+// CertificateAuthority issues SSH user certificates.
+type CertificateAuthority struct {
+	opts   *CAOptions
+	signer ssh.Signer
+}
+
+// LoadCertificateAuthority loads the CA key from the stack config, or
+// from SSHCAKeyPath, generating a new key there if necessary. A key file
+// is protected by the same passphrase as the identity.
+func LoadCertificateAuthority(opts *CAOptions, passphrase []byte) (*CertificateAuthority, error) {
+	var priv interface{}
+	var err error
+
+	if opts.Key != "" {
+		priv, err = keys.ParsePrivateKey([]byte(opts.Key), passphrase)
+		if err != nil {
+			err = fmt.Errorf("invalid ssh:caKey: %w", err)
+		}
+	} else {
+		priv, err = keys.LoadPrivateKey(SSHCAKeyPath, keys.Ed25519, passphrase)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CertificateAuthority{opts: opts, signer: signer}, nil
+}
+
+// PublicKey returns the CA public key.
+func (ca *CertificateAuthority) PublicKey() ssh.PublicKey {
+	return ca.signer.PublicKey()
+}
+
+// Issue writes a certificate for key to path, unless there is already
+// a certificate there that doesn't need to be renewed. Nothing is
+// written during a dry run.
+func (ca *CertificateAuthority) Issue(ctx *pulumi.Context, path string, keyID string, key ssh.PublicKey) error {
+	renew, err := keys.NeedsRenewal(path, ca.PublicKey(), key, ca.opts.Principals, ca.opts.Validity)
+	if err != nil {
+		return err
+	}
+
+	if !renew || ctx.DryRun() {
+		return nil
+	}
+
+	cert, err := keys.SignUserCertificate(ca.signer, key, keyID, ca.opts.Principals, ca.opts.Validity)
+	if err != nil {
+		return err
+	}
+
+	return keys.WriteCertificate(path, cert)
+}
+
+// IssueAll issues certificates for the stack identity and each of the
+// configured teammates. It returns the path to the certificate for the
+// identity.
+func (ca *CertificateAuthority) IssueAll(ctx *pulumi.Context, identity *Identity) (string, error) {
+	identityCert := keys.CertificatePath(SSHIdentityPath)
+	if err := ca.Issue(ctx, identityCert, DefaultNamePrefix, identity.Key); err != nil {
+		return "", err
+	}
+
+	if len(ca.opts.Certificates) == 0 {
+		return identityCert, nil
+	}
+
+	if err := os.MkdirAll(SSHCertificatesPath, 0700); err != nil {
+		return "", err
+	}
+
+	var names []string
+	for name := range ca.opts.Certificates {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		key, _, err := keys.ParsePublicKey(ca.opts.Certificates[name])
+		if err != nil {
+			return "", fmt.Errorf("invalid ssh:certificates key for %q: %w", name, err)
+		}
+
+		path := filepath.Join(SSHCertificatesPath, name+"-cert.pub")
+		if err := ca.Issue(ctx, path, name, key); err != nil {
+			return "", err
+		}
+	}
+
+	return identityCert, nil
+}
+
+// AddUserData configures sshd on a host to trust certificates issued by
+// the CA.
+func (ca *CertificateAuthority) AddUserData(c *cloudinit.Config) {
+	c.AddFile(cloudinit.File{
+		Path:        "/etc/ssh/trusted_user_ca_keys",
+		Content:     keys.MarshalAuthorizedKey(ca.PublicKey()) + "\n",
+		Permissions: "0644",
+	})
+
+	c.AddFile(cloudinit.File{
+		Path:        "/etc/ssh/sshd_config.d/50-trusted-user-ca.conf",
+		Content:     "TrustedUserCAKeys /etc/ssh/trusted_user_ca_keys\n",
+		Permissions: "0600",
+	})
+}
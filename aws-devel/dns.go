@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pulumi/pulumi-aws/sdk/v5/go/aws/ec2"
+	"github.com/pulumi/pulumi-aws/sdk/v5/go/aws/route53"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi/config"
+)
+
+// dnsLabel converts s to a valid DNS label, replacing anything other
+// than letters, digits and hyphens.
+func dnsLabel(s string) string {
+	return strings.Trim(strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-':
+			return r
+		default:
+			return '-'
+		}
+	}, strings.ToLower(s)), "-")
+}
+
+// NewDomain returns the name of the private DNS zone for the stack
+// hosts, from network:domain. The default is "<prefix>-<stack>.internal".
+func NewDomain(ctx *pulumi.Context) (string, error) {
+	domain := config.New(ctx, "network").Get("domain")
+	if domain == "" {
+		return dnsLabel(DefaultNamePrefix+"-"+ctx.Stack()) + ".internal", nil
+	}
+
+	domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+
+	for _, label := range strings.Split(domain, ".") {
+		if label == "" || len(label) > 63 || label != dnsLabel(label) {
+			return "", fmt.Errorf("invalid network:domain %q", domain)
+		}
+	}
+
+	return domain, nil
+}
+
+// DNS is the private DNS zone for the stack hosts, which resolves in
+// the VPC.
+type DNS struct {
+	Domain string
+	Zone   *route53.Zone
+}
+
+// NewDNS creates the private zone for domain in the VPC. The VPC needs
+// DNS support and DNS hostnames enabled for the zone to resolve.
+func NewDNS(ctx *pulumi.Context, domain string, vpc *ec2.Vpc) (*DNS, error) {
+	zone, err := route53.NewZone(ctx, "dns", &route53.ZoneArgs{
+		Name:    pulumi.String(domain),
+		Comment: pulumi.String(fmt.Sprintf("Stack hosts for %s/%s", ctx.Project(), ctx.Stack())),
+		Vpcs: route53.ZoneVpcArray{
+			&route53.ZoneVpcArgs{
+				VpcId: vpc.ID(),
+			},
+		},
+		Tags: NameTags(ctx, "dns"),
+	}, pulumi.Parent(vpc))
+	if err != nil {
+		return nil, err
+	}
+
+	return &DNS{Domain: domain, Zone: zone}, nil
+}
+
+// Name returns the fully qualified name of the host in the zone.
+func (d *DNS) Name(host string) string {
+	return host + "." + d.Domain
+}
+
+// AddHost adds an A record for the host. The record's name is
+// Name(host).
+func (d *DNS) AddHost(ctx *pulumi.Context, host string, address pulumi.StringInput) (*route53.Record, error) {
+	return route53.NewRecord(ctx, "dns/"+host, &route53.RecordArgs{
+		ZoneId:  d.Zone.ZoneId,
+		Name:    pulumi.String(d.Name(host)),
+		Type:    pulumi.String("A"),
+		Ttl:     pulumi.Int(60),
+		Records: pulumi.StringArray{address},
+	}, pulumi.Parent(d.Zone))
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/jpeach/pulumi-stacks/pkg/cloudinit"
+	"github.com/jpeach/pulumi-stacks/pkg/keys"
+)
+
+const SSHHostKeysPath = "./ssh/hostkeys"
+
+// AddHostKey adds the host key for the named host to the host's user
+// data, generating the key if necessary. It returns the public key.
+func AddHostKey(userData *cloudinit.Config, name string) (ssh.PublicKey, error) {
+	if err := os.MkdirAll(SSHHostKeysPath, 0700); err != nil {
+		return nil, err
+	}
+
+	priv, pub, err := keys.LoadHostKey(filepath.Join(SSHHostKeysPath, name+".pem"))
+	if err != nil {
+		return nil, err
+	}
+
+	userData.AddSSHHostKey("ed25519", string(priv), keys.MarshalAuthorizedKey(pub))
+	return pub, nil
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pulumi/pulumi-command/sdk/go/command/local"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi/config"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/jpeach/pulumi-stacks/pkg/conf"
+	"github.com/jpeach/pulumi-stacks/pkg/keys"
+	"github.com/jpeach/pulumi-stacks/pkg/remote"
+)
+
+// Identity is a SSH identity that can log in to the stack hosts.
+type Identity struct {
+	// Path is the file that the SSH config uses as the IdentityFile.
+	Path string
+	// Key is the public key.
+	Key ssh.PublicKey
+	// Signer signs with the private key.
+	Signer ssh.Signer
+}
+
+// IdentityOptions configures the SSH identities.
+type IdentityOptions struct {
+	Algorithm     keys.Algorithm
+	Passphrase    []byte
+	Agent         bool
+	AgentLifetime time.Duration
+	Rotation      string
+}
+
+// NewIdentityOptions reads the identity options from the "ssh"
+// config namespace.
+func NewIdentityOptions(ctx *pulumi.Context) (*IdentityOptions, error) {
+	sshOpts := config.New(ctx, "ssh")
+
+	alg, err := keys.ParseAlgorithm(sshOpts.Get("keyAlgorithm"))
+	if err != nil {
+		return nil, err
+	}
+
+	if !keys.AWS.Allows(alg) {
+		return nil, fmt.Errorf("%s keys are not supported by AWS", alg)
+	}
+
+	// Prefer the passphrase from the (secret) stack config, falling
+	// back to the environment.
+	passphrase := sshOpts.Get("passphrase")
+	if passphrase == "" {
+		passphrase = os.Getenv(keys.PassphraseEnv)
+	}
+
+	lifetime := time.Hour
+	if l := sshOpts.Get("agentLifetime"); l != "" {
+		if lifetime, err = time.ParseDuration(l); err != nil {
+			return nil, fmt.Errorf("invalid ssh:agentLifetime: %w", err)
+		}
+	}
+
+	return &IdentityOptions{
+		Algorithm:     alg,
+		Passphrase:    []byte(passphrase),
+		Agent:         sshOpts.GetBool("agent"),
+		AgentLifetime: lifetime,
+		Rotation:      sshOpts.Get("rotation"),
+	}, nil
+}
+
+// LoadIdentity loads the private key at path, generating it if
+// necessary.
+//
+// If there is a passphrase, an existing plaintext key is encrypted with
+// it. In agent mode, the key is loaded into ssh-agent and the identity
+// points at the public key, so that the agent holds the only decrypted
+// copy.
+func LoadIdentity(ctx *pulumi.Context, opts *IdentityOptions, path string) (*Identity, error) {
+	if len(opts.Passphrase) > 0 {
+		plaintext, err := keys.EncryptFile(path, opts.Passphrase, ctx.DryRun())
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+
+		switch {
+		case plaintext && ctx.DryRun():
+			_ = ctx.Log.Warn(fmt.Sprintf("%s is not encrypted, and will be encrypted with the passphrase during the update", path), nil)
+		case plaintext:
+			_ = ctx.Log.Info(fmt.Sprintf("encrypted %s with the passphrase", path), nil)
+		}
+	}
+
+	priv, err := keys.LoadPrivateKey(path, opts.Algorithm, opts.Passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	pub, err := keys.PublicKeyOf(priv)
+	if err != nil {
+		return nil, err
+	}
+
+	// The identity file might pre-date the configured algorithm.
+	if err := keys.AWS.Check(pub); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		return nil, err
+	}
+
+	if !opts.Agent {
+		return &Identity{Path: path, Key: pub, Signer: signer}, nil
+	}
+
+	pubPath := keys.PublicKeyPath(path)
+
+	// Previews don't need the agent, and shouldn't reset the lifetime
+	// of the key there.
+	if ctx.DryRun() {
+		return &Identity{Path: pubPath, Key: pub, Signer: signer}, nil
+	}
+
+	comment := strings.Join([]string{DefaultNamePrefix, ctx.Project(), ctx.Stack()}, "-")
+	if err := keys.AddToAgent(priv, comment, opts.AgentLifetime); err != nil {
+		return nil, err
+	}
+
+	if err := keys.WritePublicKey(pubPath, pub); err != nil {
+		return nil, err
+	}
+
+	return &Identity{Path: pubPath, Key: pub, Signer: signer}, nil
+}
+
+// LoadIdentities loads the current identity, followed by the previous
+// identity if this update is in the overlap window of a key rotation.
+func LoadIdentities(ctx *pulumi.Context, opts *IdentityOptions) ([]*Identity, *keys.Rotation, error) {
+	rotation, err := keys.RotateFile(SSHIdentityPath, opts.Rotation,
+		opts.Algorithm, opts.Passphrase, ctx.DryRun())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if rotation.Pending {
+		_ = ctx.Log.Info("SSH key rotation will happen during the update", nil)
+	}
+
+	if rotation.Retired {
+		_ = ctx.Log.Info("the previous SSH key is retired, since the last rotation was deployed", nil)
+	}
+
+	current, err := LoadIdentity(ctx, opts, SSHIdentityPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if rotation.Previous == "" {
+		return []*Identity{current}, rotation, nil
+	}
+
+	previous, err := LoadIdentity(ctx, opts, rotation.Previous)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return []*Identity{current, previous}, rotation, nil
+}
+
+// AuthorizedKeysStep returns the provisioning step that installs the
+// identities on the hosts, alongside the key pair that the instances
+// launched with. It is only needed while a key rotation is in progress,
+// to add the new key to the running hosts while the previous key still
+// works, and then to remove the previous key once it is retired.
+func AuthorizedKeysStep(ctx *pulumi.Context, identities []*Identity) remote.Step {
+	var pubs []ssh.PublicKey
+	for _, i := range identities {
+		pubs = append(pubs, i.Key)
+	}
+
+	return remote.Step{
+		Name:    AuthorizedKeysStepName,
+		Hosts:   []string{"bastion", "workload"},
+		Command: remote.AuthorizedKeysCommand(ctx.Project()+"/"+ctx.Stack(), pubs),
+	}
+}
+
+// TrackRotation records that the rotation was deployed once the steps
+// that installed the new key on the hosts have all succeeded. The next
+// update then retires the previous key. Until then, the previous key
+// stays, so that hosts that didn't get the new key remain reachable.
+func TrackRotation(ctx *pulumi.Context, rotation *keys.Rotation, installed []pulumi.Resource) error {
+	if rotation.Previous == "" {
+		return nil
+	}
+
+	_, _, deployedPath := keys.RotationPaths(SSHIdentityPath)
+
+	_, err := local.NewCommand(ctx, "ssh/rotation", &local.CommandArgs{
+		Create: pulumi.String(fmt.Sprintf("printf '%%s\\n' %s > %s",
+			conf.ShellQuote(rotation.Token), conf.ShellQuote(deployedPath))),
+		Triggers: pulumi.Array{pulumi.String(rotation.Token)},
+	}, pulumi.DependsOn(installed))
+
+	return err
+}
+
+// IdentityPaths returns the paths of the given identities.
+func IdentityPaths(identities []*Identity) []string {
+	var paths []string
+	for _, i := range identities {
+		paths = append(paths, i.Path)
+	}
+
+	return paths
+}
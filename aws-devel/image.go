@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pulumi/pulumi-aws/sdk/v5/go/aws/ec2"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi/config"
+)
+
+// Image is a machine image and the login user that it is
+// pre-configured with.
+type Image struct {
+	AMI          string
+	Name         string
+	User         string
+	Architecture string
+	// SSMAgent is true if the image runs the Systems Manager agent.
+	SSMAgent bool
+}
+
+// ImageFilter selects the most recent image from an owner with a name
+// that matches a pattern (using "*" and "?" wildcards).
+type ImageFilter struct {
+	Owner    string
+	Name     string
+	User     string
+	SSMAgent bool
+}
+
+// ImagePresets are the filters for the distributions that we use. The
+// AMIs are published in every region.
+var ImagePresets = map[string]ImageFilter{
+	// See https://fedoraproject.org/cloud/download. Since Fedora 40,
+	// the images are named like
+	// "Fedora-Cloud-Base-AmazonEC2.x86_64-40-1.14". The "??" matches
+	// releases, but not Rawhide or betas ("41_Beta").
+	"fedora": {
+		Owner: "125523088429",
+		Name:  "Fedora-Cloud-Base-AmazonEC2.*-??-*",
+		User:  "fedora",
+	},
+	// See https://ubuntu.com/server/docs/cloud-images/amazon-ec2.
+	"ubuntu": {
+		Owner:    "099720109477",
+		Name:     "ubuntu/images/hvm-ssd*/ubuntu-jammy-22.04-*-server-*",
+		User:     "ubuntu",
+		SSMAgent: true,
+	},
+	// See https://docs.aws.amazon.com/linux/al2023/ug/ec2.html.
+	"amazon-linux": {
+		Owner:    "amazon",
+		Name:     "al2023-ami-2023.*",
+		User:     "ec2-user",
+		SSMAgent: true,
+	},
+}
+
+// LookupImage finds the image given by the "image" config namespace.
+// An "image:id" is used as is. Otherwise, the most recent image that
+// matches the "image:preset" (default "fedora"), with any of its
+// fields overridden by "image:owner", "image:name" and "image:user",
+// is looked up for the "image:architecture" (default "x86_64") in the
+// stack region.
+func LookupImage(ctx *pulumi.Context) (*Image, error) {
+	imageOpts := config.New(ctx, "image")
+
+	preset := imageOpts.Get("preset")
+	if preset == "" {
+		preset = "fedora"
+	}
+
+	filter, ok := ImagePresets[preset]
+	if !ok {
+		var names []string
+		for n := range ImagePresets {
+			names = append(names, n)
+		}
+
+		sort.Strings(names)
+		return nil, fmt.Errorf("invalid image:preset %q, must be one of %s",
+			preset, strings.Join(names, ", "))
+	}
+
+	if v := imageOpts.Get("owner"); v != "" {
+		filter.Owner = v
+	}
+
+	if v := imageOpts.Get("name"); v != "" {
+		filter.Name = v
+	}
+
+	if v := imageOpts.Get("user"); v != "" {
+		filter.User = v
+	}
+
+	arch := imageOpts.Get("architecture")
+	if arch == "" {
+		arch = "x86_64"
+	}
+
+	image := &Image{
+		User:         filter.User,
+		Architecture: arch,
+		SSMAgent:     filter.SSMAgent,
+	}
+
+	if id := imageOpts.Get("id"); id != "" {
+		image.AMI, image.Name = id, id
+		return image, nil
+	}
+
+	ami, err := ec2.LookupAmi(ctx, &ec2.LookupAmiArgs{
+		Owners:     []string{filter.Owner},
+		MostRecent: pulumi.BoolRef(true),
+		Filters: []ec2.GetAmiFilter{
+			{Name: "name", Values: []string{filter.Name}},
+			{Name: "architecture", Values: []string{arch}},
+			{Name: "state", Values: []string{"available"}},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("no %s image matching %q from %s: %w",
+			arch, filter.Name, filter.Owner, err)
+	}
+
+	image.AMI, image.Name = ami.Id, ami.Name
+	return image, nil
+}
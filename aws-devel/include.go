@@ -0,0 +1,31 @@
+package main
+
+import (
+	"github.com/pulumi/pulumi-command/sdk/go/command/local"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+
+	"github.com/jpeach/pulumi-stacks/pkg/conf"
+)
+
+// IncludeSSHConfig includes the stack SSH configuration in the user's
+// ~/.ssh/config, so that the hosts can be reached without "ssh -F". The
+// include is removed by a command resource when the stack is destroyed,
+// since Pulumi doesn't run the program then.
+func IncludeSSHConfig(ctx *pulumi.Context, namespace string) error {
+	userConfig, err := conf.UserConfigPath()
+	if err != nil {
+		return err
+	}
+
+	if !ctx.DryRun() {
+		if err := conf.InstallInclude(userConfig, namespace, SSHConfigPath); err != nil {
+			return err
+		}
+	}
+
+	_, err = local.NewCommand(ctx, "ssh/include", &local.CommandArgs{
+		Delete: pulumi.String(conf.RemoveIncludeCommand(userConfig, namespace)),
+	})
+
+	return err
+}
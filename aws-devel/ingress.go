@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi/config"
+
+	"github.com/jpeach/pulumi-stacks/pkg/ingress"
+)
+
+// NewSSHSources reads the source addresses that are allowed to connect
+// to the bastion over SSH from ssh:allowFrom. The "auto" source is the
+// public address of the caller, as given by ssh:allowFromResolver.
+func NewSSHSources(ctx *pulumi.Context) (*ingress.Sources, error) {
+	sshOpts := config.New(ctx, "ssh")
+
+	var values []string
+	if err := sshOpts.GetObject("allowFrom", &values); err != nil {
+		return nil, fmt.Errorf("invalid ssh:allowFrom: %w", err)
+	}
+
+	return ParseSources(ctx, "ssh:allowFrom", values)
+}
+
+// ParseSources parses the source addresses given by the config key
+// like ingress.Parse does. The VPC has no IPv6 addresses, and nor does
+// the bastion, so IPv6 sources could never connect, and are rejected.
+func ParseSources(ctx *pulumi.Context, key string, values []string) (*ingress.Sources, error) {
+	sources, err := ingress.Parse(ctx.Context(), values, NewResolver(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", key, err)
+	}
+
+	if len(sources.IPv6) > 0 {
+		return nil, fmt.Errorf("invalid %s: the stack has no IPv6 addresses, so %s can't connect",
+			key, strings.Join(ingress.Strings(sources.IPv6), ", "))
+	}
+
+	return sources, nil
+}
+
+// NewResolver returns the resolver for the "auto" source, which is
+// ssh:allowFromResolver if it is set.
+func NewResolver(ctx *pulumi.Context) ingress.Resolver {
+	if url := config.New(ctx, "ssh").Get("allowFromResolver"); url != "" {
+		return &ingress.HTTPResolver{URL: url}
+	}
+
+	return ingress.DefaultResolver
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/pulumi/pulumi-aws/sdk/v5/go/aws/ec2"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// BastionInstanceTypes are the default bastion instance types for each
+// image architecture. The bastion only forwards connections, so the
+// smallest burstable type will do.
+var BastionInstanceTypes = map[string]string{
+	"x86_64": "t2.micro",
+	"arm64":  "t4g.micro",
+}
+
+// InstanceType is an instance type that can run the stack image.
+type InstanceType struct {
+	Name string
+	// Burstable is true if the instance type earns CPU credits, which
+	// only the T instance types do.
+	Burstable bool
+}
+
+// LookupInstanceType looks up the named instance type, and checks that
+// it runs images of the architecture of image. The key names the config
+// that the instance type comes from, for the errors.
+func LookupInstanceType(ctx *pulumi.Context, key string, name string, image *Image) (*InstanceType, error) {
+	t, err := ec2.GetInstanceType(ctx, &ec2.GetInstanceTypeArgs{InstanceType: name})
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s %q: %w", key, name, err)
+	}
+
+	for _, arch := range t.SupportedArchitectures {
+		if arch == image.Architecture {
+			return &InstanceType{Name: name, Burstable: t.BurstablePerformanceSupported}, nil
+		}
+	}
+
+	return nil, fmt.Errorf("invalid %s: %s instances don't run %s images like %s",
+		key, name, image.Architecture, image.Name)
+}
+
+// CreditSpecification returns the CPU credit option for the instance
+// type. Burstable instances can use unlimited credits, so that they
+// aren't throttled during long builds. Other instance types don't
+// take the option.
+func (t *InstanceType) CreditSpecification() ec2.InstanceCreditSpecificationPtrInput {
+	if !t.Burstable {
+		return nil
+	}
+
+	return &ec2.InstanceCreditSpecificationArgs{
+		CpuCredits: pulumi.String("unlimited"),
+	}
+}
@@ -8,27 +8,20 @@ import (
 	"path"
 	"strings"
 
-	"golang.org/x/crypto/ssh"
-
 	"github.com/pulumi/pulumi-aws/sdk/v5/go/aws/ec2"
 	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
 	"github.com/pulumi/pulumi/sdk/v3/go/pulumi/config"
+	"golang.org/x/crypto/ssh"
 	"inet.af/netaddr"
 
+	"github.com/jpeach/pulumi-stacks/pkg/cloudinit"
 	"github.com/jpeach/pulumi-stacks/pkg/conf"
+	"github.com/jpeach/pulumi-stacks/pkg/ingress"
+	"github.com/jpeach/pulumi-stacks/pkg/ipam"
 	"github.com/jpeach/pulumi-stacks/pkg/keys"
+	"github.com/jpeach/pulumi-stacks/pkg/remote"
 )
 
-// Networks defines the IP ranges for the networks we will build.
-var Networks = map[string]netaddr.IPPrefix{
-	"vpc":      netaddr.MustParseIPPrefix("172.16.0.0/16"), // Whole VPC.
-	"dmz":      netaddr.MustParseIPPrefix("172.16.1.0/24"), // Ingress DMZ.
-	"workload": netaddr.MustParseIPPrefix("172.16.2.0/24"), // Workloads.
-}
-
-// Fedora34 is the Fedora34 AMI image. Pre-configured user is "fedora".
-const Fedora34 = "ami-0edc79a9bdc9f4eba"
-
 const SSHIdentityPath = "./ssh/identity.pem"
 const SSHConfigPath = "./ssh/config"
 
@@ -46,114 +39,56 @@ func NameTags(ctx *pulumi.Context, id ...string) pulumi.StringMap {
 	}
 }
 
-// FirstAllocatable returns the first allocatable address in the network
-// prefix.  Skips the zero address, and the first 3 that AWS reserves in
-// each subnet.
-//
-// See https://docs.aws.amazon.com/vpc/latest/userguide/VPC_Subnets.html
-func FirstAllocatable(net netaddr.IPPrefix) (netaddr.IP, error) {
-	r := net.Range()
-	addr := r.From()
-	skipped := 0
+// AllocateWorkloads allocates the addresses of count workload instances.
+// Instance i is in the workload subnet given by the network layout, and
+// is always given the same address there.
+func AllocateWorkloads(n *Network, count int) ([]netaddr.IP, error) {
+	allocs := map[string]*ipam.Allocator{}
+	keys := map[string][]string{}
+
+	for i := 0; i < count; i++ {
+		subnet := n.Workload(i)
+		if allocs[subnet.Name] == nil {
+			alloc, err := ipam.New(ipam.AWS, subnet.Prefix)
+			if err != nil {
+				return nil, err
+			}
 
-	for {
-		if addr == r.To() {
-			return netaddr.IP{}, fmt.Errorf("network %s exhausted", net)
+			allocs[subnet.Name] = alloc
 		}
 
-		addr = addr.Next()
-		if addr.IsZero() {
-			return netaddr.IP{}, fmt.Errorf("network %s exhausted", net)
-		}
+		keys[subnet.Name] = append(keys[subnet.Name], fmt.Sprintf("workload-%d", i))
+	}
 
-		skipped++
-		if skipped > 4 {
-			return addr, nil
+	// Allocate the addresses in each subnet up front, so that no
+	// addresses are allocated if any subnet is exhausted.
+	for name, alloc := range allocs {
+		if _, err := alloc.AllocateN(keys[name]...); err != nil {
+			return nil, err
 		}
 	}
-}
-
-// SecGroupBastion is a security group for bastion instances.
-func SecGroupBastion(ctx *pulumi.Context, vpc *ec2.Vpc) (*ec2.SecurityGroup, error) {
-	return ec2.NewSecurityGroup(ctx, "bastion",
-		&ec2.SecurityGroupArgs{
-			VpcId: vpc.ID(),
-			Ingress: &ec2.SecurityGroupIngressArray{
-				// Allow inbound SSH.
-				&ec2.SecurityGroupIngressArgs{
-					CidrBlocks: pulumi.StringArray{
-						pulumi.String("0.0.0.0/0"),
-					},
-					FromPort: pulumi.Int(22),
-					ToPort:   pulumi.Int(22),
-					Protocol: pulumi.String("tcp"),
-				},
-			},
-			Egress: &ec2.SecurityGroupEgressArray{
-				// Allow any outbound.
-				&ec2.SecurityGroupEgressArgs{
-					CidrBlocks: pulumi.StringArray{
-						pulumi.String("0.0.0.0/0"),
-					},
-					FromPort: pulumi.Int(0),
-					ToPort:   pulumi.Int(0),
-					Protocol: pulumi.String("-1"),
-				},
-			},
-			Tags: NameTags(ctx, "sec", "bastion"),
-		},
-	)
-}
 
-// SecGroupWorkload is a security group for workload instances.
-func SecGroupWorkload(ctx *pulumi.Context, vpc *ec2.Vpc) (*ec2.SecurityGroup, error) {
-	return ec2.NewSecurityGroup(ctx, "workload",
-		&ec2.SecurityGroupArgs{
-			VpcId: vpc.ID(),
-			// Allow any inbound.
-			Ingress: &ec2.SecurityGroupIngressArray{
-				&ec2.SecurityGroupIngressArgs{
-					CidrBlocks: pulumi.StringArray{
-						pulumi.String("0.0.0.0/0"),
-					},
-					FromPort: pulumi.Int(0),
-					ToPort:   pulumi.Int(0),
-					Protocol: pulumi.String("-1"),
-				},
-			},
-			// Allow any outbound.
-			Egress: &ec2.SecurityGroupEgressArray{
-				&ec2.SecurityGroupEgressArgs{
-					CidrBlocks: pulumi.StringArray{
-						pulumi.String("0.0.0.0/0"),
-					},
-					FromPort: pulumi.Int(0),
-					ToPort:   pulumi.Int(0),
-					Protocol: pulumi.String("-1"),
-				},
-			},
-			Tags: NameTags(ctx, "sec", "workload"),
-		},
-	)
-}
+	addrs := make([]netaddr.IP, count)
+	for i := range addrs {
+		ip, err := allocs[n.Workload(i).Name].Allocate(fmt.Sprintf("workload-%d", i))
+		if err != nil {
+			return nil, err
+		}
 
-// InitSecurityGroups ...
-func InitSecurityGroups(ctx *pulumi.Context, vpc *ec2.Vpc) error {
-	sec := map[string]func(ctx *pulumi.Context, vpc *ec2.Vpc) (*ec2.SecurityGroup, error){
-		"Bastion":  SecGroupBastion,
-		"Workload": SecGroupWorkload,
+		addrs[i] = ip
 	}
 
-	for n, f := range sec {
-		grp, err := f(ctx, vpc)
-		if err != nil {
-			return err
-		}
+	return addrs, nil
+}
 
-		SecurityGroups[n] = grp
+// UserDataBase64 returns the encoded user data as an instance argument.
+// Empty user data is omitted.
+func UserDataBase64(data string) pulumi.StringPtrInput {
+	if data == "" {
+		return nil
 	}
 
-	return nil
+	return pulumi.String(data)
 }
 
 // NewBastion ...
@@ -162,21 +97,34 @@ func NewBastion(
 	vpc *ec2.Vpc,
 	subnet *ec2.Subnet,
 	keys *ec2.KeyPair,
+	image *Image,
+	instanceType *InstanceType,
+	userData *cloudinit.Config,
 ) (*ec2.Instance, error) {
+	doc, err := cloudinit.NewUserData(userData)
+	if err != nil {
+		return nil, err
+	}
+
+	data, _, err := doc.Encode()
+	if err != nil {
+		return nil, err
+	}
+
 	return ec2.NewInstance(ctx, fmt.Sprintf("bastion/%d", 0), &ec2.InstanceArgs{
-		Ami:                      pulumi.String(Fedora34),
-		InstanceType:             pulumi.String("t2.micro"),
+		Ami:                      pulumi.String(image.AMI),
+		InstanceType:             pulumi.String(instanceType.Name),
 		KeyName:                  keys.KeyName,
+		UserDataBase64:           UserDataBase64(data),
+		UserDataReplaceOnChange:  pulumi.Bool(true),
 		SubnetId:                 subnet.ID(),
 		AssociatePublicIpAddress: pulumi.Bool(true),
 		VpcSecurityGroupIds: pulumi.StringArray{
 			SecurityGroups["Bastion"].ID().ToStringOutput(),
 		},
-		CreditSpecification: &ec2.InstanceCreditSpecificationArgs{
-			CpuCredits: pulumi.String("unlimited"),
-		},
-		Tags: NameTags(ctx, "bastion"),
-	})
+		CreditSpecification: instanceType.CreditSpecification(),
+		Tags:                NameTags(ctx, "bastion"),
+	}, pulumi.IgnoreChanges([]string{"keyName"}))
 }
 
 func main() {
@@ -191,170 +139,328 @@ func main() {
 		log.Fatalf("%s", err)
 	}
 
-	sshKey, err := keys.NewPublicKey(SSHIdentityPath)
-	if err != nil {
-		log.Fatalf("%s", err)
-	}
+	pulumi.Run(func(ctx *pulumi.Context) error {
+		// Config for workload instances.
+		workloadConf := config.New(ctx, "workload")
 
-	sshConf, err := conf.NewSSH(SSHConfigPath)
-	if err != nil {
-		log.Fatalf("%s", err)
-	}
+		access, err := NewAccessMode(ctx)
+		if err != nil {
+			return err
+		}
 
-	pulumi.Run(func(ctx *pulumi.Context) error {
-		keys, err := ec2.NewKeyPair(ctx, "dev", &ec2.KeyPairArgs{
-			PublicKey: pulumi.String(ssh.MarshalAuthorizedKey(sshKey)),
-			Tags:      NameTags(ctx, "keys"),
-		})
+		// In the Session Manager mode, there is no bastion to allow
+		// SSH to.
+		var sshSources *ingress.Sources
+		if access == AccessBastion {
+			if sshSources, err = NewSSHSources(ctx); err != nil {
+				return err
+			}
+
+			ctx.Export("ssh.allowFrom", pulumi.ToStringArray(ingress.Strings(sshSources.IPv4)))
+		}
+
+		netLayout, err := NewNetwork(ctx)
 		if err != nil {
 			return err
 		}
 
-		vpc, err := ec2.NewVpc(ctx, "vpc", &ec2.VpcArgs{
-			CidrBlock:        pulumi.String(Networks["vpc"].String()),
-			EnableDnsSupport: pulumi.Bool(true),
-			Tags:             NameTags(ctx, "vpc"),
-		})
+		wg, err := NewWireGuard(ctx, netLayout)
 		if err != nil {
 			return err
 		}
 
-		err = InitSecurityGroups(ctx, vpc)
+		if wg != nil && access != AccessBastion {
+			return fmt.Errorf("wireguard:enabled needs a bastion, but ssh:access is %q", access)
+		}
+
+		secGroups, err := NewSecGroups(ctx, netLayout, sshSources, wg)
 		if err != nil {
 			return err
 		}
 
-		dmzSubnet, err := ec2.NewSubnet(ctx, "dmz", &ec2.SubnetArgs{
-			VpcId:               vpc.ID(),
-			CidrBlock:           pulumi.String(Networks["dmz"].String()),
-			MapPublicIpOnLaunch: pulumi.Bool(true),
-			Tags:                NameTags(ctx, "dmz"),
-		})
+		// Allocate the workload addresses before creating any
+		// resources, so that running out of addresses fails early.
+		workloadAddrs, err := AllocateWorkloads(netLayout, workloadConf.RequireInt("instanceCount"))
 		if err != nil {
 			return err
 		}
 
-		gw, err := ec2.NewInternetGateway(ctx, "gw", &ec2.InternetGatewayArgs{
-			VpcId: vpc.ID(),
-			Tags:  NameTags(ctx, "gw"),
-		}, pulumi.Parent(dmzSubnet))
+		pools, err := WorkloadPools(ctx, len(workloadAddrs))
 		if err != nil {
 			return err
 		}
 
-		gwRoutes, err := ec2.NewRouteTable(ctx, "routes/gw", &ec2.RouteTableArgs{
-			VpcId: vpc.ID(),
-			Routes: ec2.RouteTableRouteArray{
-				&ec2.RouteTableRouteArgs{
-					CidrBlock: pulumi.String("0.0.0.0/0"),
-					GatewayId: gw.ID(),
-				},
-			},
-			Tags: NameTags(ctx, "gw-routes"),
-		}, pulumi.Parent(dmzSubnet))
+		sshOpts := config.New(ctx, "ssh")
+
+		// Pre-generate the host keys, so that SSH can verify the
+		// hosts on first use.
+		pinHostKeys := sshOpts.GetBool("pinHostKeys")
+
+		// Including the SSH config in ~/.ssh/config requires the
+		// host aliases to be unique across stacks.
+		include := sshOpts.GetBool("include")
+
+		var namespace string
+		if include {
+			namespace = fmt.Sprintf("%s-%s", ctx.Project(), ctx.Stack())
+		}
+
+		// Write an Ansible inventory in the given format.
+		var inventory string
+		if format := sshOpts.Get("inventory"); format != "" {
+			inventory = path.Join(path.Dir(SSHConfigPath), "inventory."+format)
+		}
+
+		sshConf, err := conf.NewSSH(SSHConfigPath, conf.Options{
+			PinHostKeys: pinHostKeys,
+			DryRun:      ctx.DryRun(),
+			Namespace:   namespace,
+			Inventory:   inventory,
+		})
 		if err != nil {
 			return err
 		}
 
-		_, err = ec2.NewRouteTableAssociation(ctx, "gw/dmz", &ec2.RouteTableAssociationArgs{
-			SubnetId:     dmzSubnet.ID(),
-			RouteTableId: gwRoutes.ID(),
-		}, pulumi.Parent(gwRoutes))
+		if include {
+			if err := IncludeSSHConfig(ctx, namespace); err != nil {
+				return err
+			}
+		}
+
+		image, err := LookupImage(ctx)
 		if err != nil {
 			return err
 		}
 
-		workloadSubnet, err := ec2.NewSubnet(ctx, "workload", &ec2.SubnetArgs{
-			VpcId:     vpc.ID(),
-			CidrBlock: pulumi.String(Networks["workload"].String()),
-			Tags:      NameTags(ctx, "workload"),
-		})
+		ctx.Export("image.id", pulumi.String(image.AMI))
+		ctx.Export("image.name", pulumi.String(image.Name))
+
+		workloadType, err := LookupInstanceType(ctx, "workload:instanceType",
+			workloadConf.Require("instanceType"), image)
 		if err != nil {
 			return err
 		}
 
-		natEIP, err := ec2.NewEip(ctx, "eip/nat", &ec2.EipArgs{
-			Vpc:  pulumi.Bool(true),
-			Tags: NameTags(ctx, "nat-eip"),
-		})
+		identityOpts, err := NewIdentityOptions(ctx)
 		if err != nil {
 			return err
 		}
 
-		// The NAT gateway has to be in dmz subnet so it can use the
-		// internet gateway there to get out.
-		nat, err := ec2.NewNatGateway(ctx, "nat", &ec2.NatGatewayArgs{
-			AllocationId:     natEIP.ID(),
-			SubnetId:         dmzSubnet.ID(),
-			ConnectivityType: pulumi.String("public"),
-			Tags:             NameTags(ctx, "nat"),
-		}, pulumi.Parent(workloadSubnet))
+		identities, rotation, err := LoadIdentities(ctx, identityOpts)
 		if err != nil {
 			return err
 		}
 
-		natRoutes, err := ec2.NewRouteTable(ctx, "routes/nat", &ec2.RouteTableArgs{
-			VpcId: vpc.ID(),
-			Routes: ec2.RouteTableRouteArray{
-				&ec2.RouteTableRouteArgs{
-					CidrBlock:    pulumi.String("0.0.0.0/0"),
-					NatGatewayId: nat.ID(),
-				},
-			},
-			Tags: NameTags(ctx, "nat-routes"),
-		}, pulumi.Parent(workloadSubnet))
+		topology, err := NewTopology(ctx, image, IdentityPaths(identities))
 		if err != nil {
 			return err
 		}
 
-		_, err = ec2.NewRouteTableAssociation(ctx, "nat/workload", &ec2.RouteTableAssociationArgs{
-			SubnetId:     workloadSubnet.ID(),
-			RouteTableId: natRoutes.ID(),
-		}, pulumi.Parent(natRoutes))
+		if err := topology.WriteJumpHosts(sshConf); err != nil {
+			return err
+		}
+
+		waitOpts, err := NewWaitOptions(ctx)
+		if err != nil {
+			return err
+		}
+
+		readiness := NewReadiness(waitOpts, topology, identities)
+
+		if identityOpts.Agent {
+			sock, err := keys.AgentSocket()
+			if err != nil {
+				return err
+			}
+
+			sshConf.SetIdentityAgent(sock)
+		}
+
+		// User data that is common to all the hosts.
+		userData := &cloudinit.Config{}
+
+		caOpts, err := NewCAOptions(ctx, image)
 		if err != nil {
 			return err
 		}
 
-		// Per the guide linked below, the routing table with the NAT
-		// gateway should be the main table.
-		//
-		// https://docs.aws.amazon.com/vpc/latest/userguide/VPC_Scenario2.html
-		_, err = ec2.NewMainRouteTableAssociation(ctx, "main", &ec2.MainRouteTableAssociationArgs{
-			VpcId:        vpc.ID(),
-			RouteTableId: natRoutes.ID(),
+		if caOpts.Enabled {
+			ca, err := LoadCertificateAuthority(caOpts, identityOpts.Passphrase)
+			if err != nil {
+				return err
+			}
+
+			cert, err := ca.IssueAll(ctx, identities[0])
+			if err != nil {
+				return err
+			}
+
+			if err := sshConf.SetCertificate(cert); err != nil {
+				return err
+			}
+
+			ca.AddUserData(userData)
+		}
+
+		// The key pair is only installed when an instance launches,
+		// so the running instances get a new key from the authorized
+		// keys step instead, see AuthorizedKeysStep.
+		keyPair, err := ec2.NewKeyPair(ctx, "dev", &ec2.KeyPairArgs{
+			PublicKey: pulumi.String(keys.MarshalAuthorizedKey(identities[0].Key)),
+			Tags:      NameTags(ctx, "keys"),
 		})
 		if err != nil {
 			return err
 		}
 
-		bastion, err := NewBastion(ctx, vpc, dmzSubnet, keys)
+		network, err := NewVPC(ctx, netLayout)
 		if err != nil {
 			return err
 		}
 
-		ctx.Export("bastion.addr", bastion.PublicIp)
-		bastion.PublicIp.ApplyT(func(addr string) (string, error) {
-			err := sshConf.WriteBastionHost(addr, SSHIdentityPath)
-			return "", err
-		})
+		vpc := network.Vpc
 
-		addr, err := FirstAllocatable(Networks["workload"])
+		ctx.Export("network.vpc", pulumi.String(netLayout.VPC.String()))
+		for _, s := range netLayout.Subnets {
+			ctx.Export("network.subnet."+s.Name, pulumi.String(s.Prefix.String()))
+		}
+
+		dns, err := NewDNS(ctx, topology.Domain, vpc)
 		if err != nil {
 			return err
 		}
 
-		// Config for workload instances.
-		workloadConf := config.New(ctx, "workload")
+		ctx.Export("network.domain", pulumi.String(dns.Domain))
+
+		err = InitSecurityGroups(ctx, vpc, secGroups)
+		if err != nil {
+			return err
+		}
+
+		var builtin []remote.Step
+		if rotation.Previous != "" || rotation.Retired {
+			builtin = append(builtin, AuthorizedKeysStep(ctx, identities))
+		}
+
+		provision, err := NewRemote(ctx, sshConf, builtin...)
+		if err != nil {
+			return err
+		}
+
+		// written resolves once the SSH config has the entries that
+		// the provisioning steps connect through, and env passes it
+		// to the steps.
+		var written pulumi.StringOutput
+		var env pulumi.StringMap
+
+		var bastionAddr pulumi.StringOutput
+		var bastionKey ssh.PublicKey
+
+		if access == AccessBastion {
+			bastionData := userData.Copy()
+
+			if wg != nil {
+				if err := wg.AddUserData(bastionData); err != nil {
+					return err
+				}
+			}
+
+			if pinHostKeys {
+				if bastionKey, err = AddHostKey(bastionData, "bastion-0"); err != nil {
+					return err
+				}
+			}
+
+			name := config.New(ctx, "bastion").Get("instanceType")
+			if name == "" {
+				if name = BastionInstanceTypes[image.Architecture]; name == "" {
+					return fmt.Errorf("bastion:instanceType is required for %s images", image.Architecture)
+				}
+			}
+
+			bastionType, err := LookupInstanceType(ctx, "bastion:instanceType", name, image)
+			if err != nil {
+				return err
+			}
+
+			bastion, err := NewBastion(ctx, vpc, network.Public, keyPair, image, bastionType, bastionData)
+			if err != nil {
+				return err
+			}
+
+			bastionAddr = bastion.PublicIp
+
+			ctx.Export("bastion.addr", bastion.PublicIp)
 
-		for i := 0; i < workloadConf.RequireInt("instanceCount"); i++ {
-			addr = addr.Next()
-			if addr.IsZero() {
-				return fmt.Errorf("IP range %s exhausted", Networks["workload"].String())
+			bastionRecord, err := dns.AddHost(ctx, "bastion", bastion.PrivateIp)
+			if err != nil {
+				return err
 			}
 
+			readiness.AddDependency(bastionRecord)
+
+			ctx.Export("bastion.name", pulumi.String(dns.Name("bastion")))
+
+			if wg != nil {
+				ctx.Export("wireguard.endpoint", bastion.PublicIp.ApplyT(func(addr string) string {
+					return fmt.Sprintf("%s:%d", addr, wg.Port)
+				}).(pulumi.StringOutput))
+
+				if err := wg.WriteClientConfig(ctx, bastion.PublicIp); err != nil {
+					return err
+				}
+			}
+			// written resolves to the bastion address once the
+			// SSH config entry for the bastion is written.
+			written = bastion.PublicIp.ApplyT(func(addr string) (string, error) {
+				if err := sshConf.WriteHost(topology.Bastion(addr)); err != nil {
+					return "", err
+				}
+
+				if bastionKey != nil {
+					if err := sshConf.WriteKnownHost(addr, bastionKey); err != nil {
+						return "", err
+					}
+				}
+
+				return addr, nil
+			}).(pulumi.StringOutput)
+
+			env = pulumi.StringMap{"BASTION_ADDR": written}
+
+			// Only the name and groups of the host matter here.
+			if err := provision.Run(ctx, topology.Bastion(""), bastion, env); err != nil {
+				return err
+			}
+		}
+
+		var instanceProfile pulumi.StringInput
+		if access == AccessSSM {
+			profile, err := NewSSMInstanceProfile(ctx)
+			if err != nil {
+				return err
+			}
+
+			instanceProfile = profile.Name
+
+			if err := AddSSMAgent(userData, image); err != nil {
+				return err
+			}
+		}
+
+		workloadData, err := NewWorkloadUserData(ctx)
+		if err != nil {
+			return err
+		}
+
+		var ssmWritten []interface{}
+
+		for i, addr := range workloadAddrs {
+			subnet := network.Subnets[netLayout.Workload(i).Name]
+
 			iface, err := ec2.NewNetworkInterface(ctx, fmt.Sprintf("priv/%d", i),
 				&ec2.NetworkInterfaceArgs{
-					SubnetId: workloadSubnet.ID(),
+					SubnetId: subnet.ID(),
 					PrivateIps: pulumi.StringArray{
 						pulumi.String(addr.String()),
 					},
@@ -362,36 +468,126 @@ func main() {
 						SecurityGroups["Workload"].ID().ToStringOutput(),
 					},
 					Tags: NameTags(ctx, fmt.Sprintf("iface-%d", i)),
-				}, pulumi.Parent(workloadSubnet))
+				}, pulumi.Parent(subnet))
+			if err != nil {
+				return err
+			}
+
+			instanceData := userData.Copy()
+
+			var hostKey ssh.PublicKey
+			if pinHostKeys {
+				if hostKey, err = AddHostKey(instanceData, fmt.Sprintf("workload-%d", i)); err != nil {
+					return err
+				}
+			}
+
+			data, digest, err := workloadData.Encode(instanceData)
 			if err != nil {
 				return err
 			}
 
-			instanceType := workloadConf.Require("instanceType")
+			// The instance is replaced when the digest changes.
+			ctx.Export(fmt.Sprintf("workload.userData.%d", i), pulumi.String(digest))
 
-			_, err = ec2.NewInstance(ctx, fmt.Sprintf("instance/%d", i), &ec2.InstanceArgs{
-				Ami:          pulumi.String(Fedora34),
-				InstanceType: pulumi.String(instanceType),
-				KeyName:      keys.KeyName,
+			instance, err := ec2.NewInstance(ctx, fmt.Sprintf("instance/%d", i), &ec2.InstanceArgs{
+				Ami:            pulumi.String(image.AMI),
+				InstanceType:   pulumi.String(workloadType.Name),
+				KeyName:        keyPair.KeyName,
+				UserDataBase64: UserDataBase64(data),
 				NetworkInterfaces: ec2.InstanceNetworkInterfaceArray{
 					&ec2.InstanceNetworkInterfaceArgs{
 						NetworkInterfaceId: iface.ID(),
 						DeviceIndex:        pulumi.Int(0),
 					},
 				},
-				CreditSpecification: &ec2.InstanceCreditSpecificationArgs{
-					CpuCredits: pulumi.String("unlimited"),
-				},
-				Tags: NameTags(ctx, fmt.Sprintf("workload-%d", i)),
-			}, pulumi.Parent(iface))
+				CreditSpecification:     workloadType.CreditSpecification(),
+				IamInstanceProfile:      instanceProfile,
+				UserDataReplaceOnChange: pulumi.Bool(true),
+				Tags:                    NameTags(ctx, fmt.Sprintf("workload-%d", i)),
+			}, pulumi.Parent(iface), pulumi.IgnoreChanges([]string{"keyName"}))
 			if err != nil {
 				return err
 			}
 
 			ctx.Export(fmt.Sprintf("workload.addr.%d", i), pulumi.String(addr.String()))
-			sshConf.WriteWorkloadHost(addr.String(), SSHIdentityPath)
+			ctx.Export(fmt.Sprintf("workload.zone.%d", i), subnet.AvailabilityZone)
+			ctx.Export(fmt.Sprintf("workload.instance.%d", i), instance.ID())
+
+			record, err := dns.AddHost(ctx, fmt.Sprintf("workload-%d", i), pulumi.String(addr.String()))
+			if err != nil {
+				return err
+			}
+
+			readiness.AddDependency(record)
+
+			ctx.Export(fmt.Sprintf("workload.name.%d", i), pulumi.String(dns.Name(fmt.Sprintf("workload-%d", i))))
+
+			host := topology.Workload(fmt.Sprintf("workload-%d", i), addr.String(), pools[i])
+			if zone := netLayout.Zone(netLayout.Workload(i).Zone); zone != "" {
+				host.Groups = append(host.Groups, "zone_"+groupName(zone))
+			}
+
+			readiness.AddWorkload(host, hostKey, instance)
+
+			// In the Session Manager mode, the SSH config entry is
+			// keyed by the instance ID, so it is written once the
+			// instance exists.
+			if access == AccessSSM {
+				hostWritten := instance.ID().ToStringOutput().ApplyT(func(id string) (string, error) {
+					host := host
+					host.Address = id
+
+					if err := sshConf.WriteHost(host); err != nil {
+						return "", err
+					}
+
+					if hostKey != nil {
+						if err := sshConf.WriteKnownHost(id, hostKey); err != nil {
+							return "", err
+						}
+					}
+
+					return id, nil
+				}).(pulumi.StringOutput)
+
+				ssmWritten = append(ssmWritten, hostWritten)
+				if err := provision.Run(ctx, host, instance, pulumi.StringMap{"INSTANCE_ID": hostWritten}); err != nil {
+					return err
+				}
+
+				continue
+			}
+
+			if err := sshConf.WriteHost(host); err != nil {
+				return err
+			}
+
+			if err := provision.Run(ctx, host, instance, env); err != nil {
+				return err
+			}
+
+			if hostKey != nil {
+				if err := sshConf.WriteKnownHost(host.Address, hostKey); err != nil {
+					return err
+				}
+			}
 		}
 
-		return nil
+		if access == AccessSSM {
+			written = pulumi.All(ssmWritten...).ApplyT(func(ids []interface{}) string {
+				return fmt.Sprint(ids...)
+			}).(pulumi.StringOutput)
+		}
+
+		if err := TrackRotation(ctx, rotation, provision.Installed()); err != nil {
+			return err
+		}
+
+		readiness.Wait(ctx, bastionAddr, bastionKey)
+
+		// The SSH config is tracked last, since it waits for the
+		// entries that are written once the hosts exist.
+		return TrackSSHConfig(ctx, sshConf, written)
 	})
 }
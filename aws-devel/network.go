@@ -0,0 +1,436 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pulumi/pulumi-aws/sdk/v5/go/aws"
+	"github.com/pulumi/pulumi-aws/sdk/v5/go/aws/ec2"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi/config"
+	"inet.af/netaddr"
+
+	"github.com/jpeach/pulumi-stacks/pkg/ipam"
+)
+
+// DefaultVPC is the default IP range of the VPC.
+var DefaultVPC = netaddr.MustParseIPPrefix("172.16.0.0/16")
+
+// DefaultSubnets are the default subnets of the VPC.
+var DefaultSubnets = []SubnetConfig{
+	{Name: "dmz", CIDR: "172.16.1.0/24", Role: "public"},       // Ingress DMZ.
+	{Name: "workload", CIDR: "172.16.2.0/24", Role: "private"}, // Workloads.
+}
+
+// SubnetConfig configures a subnet of the VPC. Either CIDR gives the
+// subnet range, or Size gives the prefix length of a range to carve
+// from the free space in the VPC.
+type SubnetConfig struct {
+	Name string `json:"name"`
+	CIDR string `json:"cidr,omitempty"`
+	Size int    `json:"size,omitempty"`
+	// Role is "public" for subnets that route through the internet
+	// gateway, or "private" for subnets that route through the NAT
+	// gateway.
+	Role string `json:"role"`
+}
+
+// Subnet is a subnet of the VPC.
+type Subnet struct {
+	Name   string
+	Prefix netaddr.IPPrefix
+	Public bool
+	// Zone is the index of the availability zone of the subnet.
+	Zone int
+}
+
+// Network is the layout of the VPC. The configured subnets are created
+// in each availability zone. In the first zone, the subnets have the
+// configured names and ranges. In the other zones, the names have a
+// "-<zone>" suffix and the ranges are carved from the free space in the
+// VPC.
+//
+// The bastion and the NAT gateway are in the first public subnet of the
+// first zone, and the workloads are spread across the first private
+// subnet of each zone.
+type Network struct {
+	VPC netaddr.IPPrefix
+	// Zones are the names of the availability zones. If there are
+	// none, AWS chooses the zone.
+	Zones []string
+	// NATPerZone is true if each zone has its own NAT gateway.
+	NATPerZone bool
+	Subnets    []Subnet
+}
+
+// NewNetwork reads the network layout from the "network" config
+// namespace, and looks up the availability zones if more than one zone
+// is configured.
+func NewNetwork(ctx *pulumi.Context) (*Network, error) {
+	netOpts := config.New(ctx, "network")
+
+	n := &Network{
+		VPC:        DefaultVPC,
+		NATPerZone: netOpts.GetBool("natPerZone"),
+	}
+
+	if v := netOpts.Get("vpc"); v != "" {
+		p, err := netaddr.ParseIPPrefix(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network:vpc: %w", err)
+		}
+
+		n.VPC = p
+	}
+
+	zones, err := lookupZones(ctx, netOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	n.Zones = zones
+
+	var subnets []SubnetConfig
+	if err := netOpts.GetObject("subnets", &subnets); err != nil {
+		return nil, fmt.Errorf("invalid network:subnets: %w", err)
+	}
+
+	if subnets == nil {
+		subnets = DefaultSubnets
+	}
+
+	var reqs []ipam.SubnetRequest
+	names := map[string]bool{}
+
+	for _, s := range subnets {
+		switch {
+		case s.Name == "":
+			return nil, fmt.Errorf("invalid network:subnets: name is required")
+		case names[s.Name]:
+			return nil, fmt.Errorf("invalid network:subnets: duplicate name %q", s.Name)
+		case s.Role != "public" && s.Role != "private":
+			return nil, fmt.Errorf("invalid network:subnets: subnet %q role must be \"public\" or \"private\"", s.Name)
+		case (s.CIDR == "") == (s.Size == 0):
+			return nil, fmt.Errorf("invalid network:subnets: subnet %q needs one of cidr or size", s.Name)
+		case s.Size < 0 || s.Size > 32:
+			return nil, fmt.Errorf("invalid network:subnets: subnet %q size /%d is invalid", s.Name, s.Size)
+		}
+
+		names[s.Name] = true
+
+		r := ipam.SubnetRequest{Name: s.Name, Bits: uint8(s.Size)}
+		if s.CIDR != "" {
+			p, err := netaddr.ParseIPPrefix(s.CIDR)
+			if err != nil {
+				return nil, fmt.Errorf("invalid network:subnets: subnet %q: %w", s.Name, err)
+			}
+
+			r.Prefix = p
+			r.Bits = p.Bits()
+		}
+
+		reqs = append(reqs, r)
+		n.Subnets = append(n.Subnets, Subnet{Name: s.Name, Public: s.Role == "public"})
+	}
+
+	// The subnets in the other zones are carved after the first zone,
+	// so that adding a zone doesn't move the existing subnets.
+	for z := 1; z < n.ZoneCount(); z++ {
+		for i, s := range subnets {
+			name := fmt.Sprintf("%s-%d", s.Name, z)
+			if names[name] {
+				return nil, fmt.Errorf("invalid network:subnets: %q is the name of subnet %q in zone %d",
+					name, s.Name, z)
+			}
+
+			reqs = append(reqs, ipam.SubnetRequest{Name: name, Bits: reqs[i].Bits})
+			n.Subnets = append(n.Subnets, Subnet{Name: name, Public: s.Role == "public", Zone: z})
+		}
+	}
+
+	prefixes, err := ipam.Layout(ipam.AWS, n.VPC, reqs)
+	if err != nil {
+		return nil, fmt.Errorf("invalid network:subnets: %w", err)
+	}
+
+	n.VPC = n.VPC.Masked()
+	for i := range n.Subnets {
+		n.Subnets[i].Prefix = prefixes[i]
+	}
+
+	if n.Public(0) == nil || n.Private(0) == nil {
+		return nil, fmt.Errorf("invalid network:subnets: at least one public and one private subnet are required")
+	}
+
+	return n, nil
+}
+
+// lookupZones returns the availability zones given by network:zones,
+// or the first network:zoneCount available zones in the region.
+func lookupZones(ctx *pulumi.Context, netOpts *config.Config) ([]string, error) {
+	var names []string
+	if err := netOpts.GetObject("zones", &names); err != nil {
+		return nil, fmt.Errorf("invalid network:zones: %w", err)
+	}
+
+	count := netOpts.GetInt("zoneCount")
+	if count < 0 {
+		return nil, fmt.Errorf("invalid network:zoneCount %d", count)
+	}
+
+	if len(names) == 0 && count <= 1 {
+		return nil, nil
+	}
+
+	// Only zones that are enabled by default; local zones and
+	// wavelength zones have to be opted in to.
+	available, err := aws.GetAvailabilityZones(ctx, &aws.GetAvailabilityZonesArgs{
+		State: pulumi.StringRef("available"),
+		Filters: []aws.GetAvailabilityZonesFilter{
+			{Name: "opt-in-status", Values: []string{"opt-in-not-required"}},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up availability zones: %w", err)
+	}
+
+	if len(names) == 0 {
+		if count > len(available.Names) {
+			return nil, fmt.Errorf("invalid network:zoneCount %d, only %d zones are available",
+				count, len(available.Names))
+		}
+
+		return available.Names[:count], nil
+	}
+
+	seen := map[string]bool{}
+	for _, z := range names {
+		switch {
+		case seen[z]:
+			return nil, fmt.Errorf("invalid network:zones: duplicate zone %q", z)
+		case !contains(available.Names, z):
+			return nil, fmt.Errorf("invalid network:zones: zone %q is not available, must be one of %s",
+				z, strings.Join(available.Names, ", "))
+		}
+
+		seen[z] = true
+	}
+
+	return names, nil
+}
+
+func contains(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ZoneCount returns the number of availability zones.
+func (n *Network) ZoneCount() int {
+	if len(n.Zones) == 0 {
+		return 1
+	}
+
+	return len(n.Zones)
+}
+
+// Zone returns the name of availability zone z, or "" if AWS chooses
+// the zone.
+func (n *Network) Zone(z int) string {
+	if len(n.Zones) == 0 {
+		return ""
+	}
+
+	return n.Zones[z]
+}
+
+// Public returns the first public subnet in zone z.
+func (n *Network) Public(z int) *Subnet {
+	for i := range n.Subnets {
+		if n.Subnets[i].Public && n.Subnets[i].Zone == z {
+			return &n.Subnets[i]
+		}
+	}
+
+	return nil
+}
+
+// Private returns the first private subnet in zone z.
+func (n *Network) Private(z int) *Subnet {
+	for i := range n.Subnets {
+		if !n.Subnets[i].Public && n.Subnets[i].Zone == z {
+			return &n.Subnets[i]
+		}
+	}
+
+	return nil
+}
+
+// Workload returns the subnet for workload instance i. The instances
+// are spread round-robin across the zones.
+func (n *Network) Workload(i int) *Subnet {
+	return n.Private(i % n.ZoneCount())
+}
+
+// VPC holds the network resources.
+type VPC struct {
+	Vpc *ec2.Vpc
+	// Subnets are the subnet resources, keyed by name.
+	Subnets map[string]*ec2.Subnet
+	// Public is the subnet for the bastion.
+	Public *ec2.Subnet
+}
+
+// NewVPC creates the VPC and its subnets. Public subnets route through
+// an internet gateway, and private subnets through a NAT gateway in the
+// first public subnet, or in the first public subnet of their own zone.
+func NewVPC(ctx *pulumi.Context, n *Network) (*VPC, error) {
+	vpc, err := ec2.NewVpc(ctx, "vpc", &ec2.VpcArgs{
+		CidrBlock:          pulumi.String(n.VPC.String()),
+		EnableDnsSupport:   pulumi.Bool(true),
+		EnableDnsHostnames: pulumi.Bool(true),
+		Tags:               NameTags(ctx, "vpc"),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	v := &VPC{
+		Vpc:     vpc,
+		Subnets: map[string]*ec2.Subnet{},
+	}
+
+	for _, s := range n.Subnets {
+		args := &ec2.SubnetArgs{
+			VpcId:     vpc.ID(),
+			CidrBlock: pulumi.String(s.Prefix.String()),
+			Tags:      NameTags(ctx, s.Name),
+		}
+
+		if s.Public {
+			args.MapPublicIpOnLaunch = pulumi.Bool(true)
+		}
+
+		if z := n.Zone(s.Zone); z != "" {
+			args.AvailabilityZone = pulumi.String(z)
+		}
+
+		subnet, err := ec2.NewSubnet(ctx, s.Name, args)
+		if err != nil {
+			return nil, err
+		}
+
+		v.Subnets[s.Name] = subnet
+	}
+
+	v.Public = v.Subnets[n.Public(0).Name]
+
+	gw, err := ec2.NewInternetGateway(ctx, "gw", &ec2.InternetGatewayArgs{
+		VpcId: vpc.ID(),
+		Tags:  NameTags(ctx, "gw"),
+	}, pulumi.Parent(v.Public))
+	if err != nil {
+		return nil, err
+	}
+
+	gwRoutes, err := ec2.NewRouteTable(ctx, "routes/gw", &ec2.RouteTableArgs{
+		VpcId: vpc.ID(),
+		Routes: ec2.RouteTableRouteArray{
+			&ec2.RouteTableRouteArgs{
+				CidrBlock: pulumi.String("0.0.0.0/0"),
+				GatewayId: gw.ID(),
+			},
+		},
+		Tags: NameTags(ctx, "gw-routes"),
+	}, pulumi.Parent(v.Public))
+	if err != nil {
+		return nil, err
+	}
+
+	nats := 1
+	if n.NATPerZone {
+		nats = n.ZoneCount()
+	}
+
+	natRoutes := make([]*ec2.RouteTable, nats)
+	for z := range natRoutes {
+		if natRoutes[z], err = v.newNAT(ctx, n, z); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, s := range n.Subnets {
+		name, routes := "nat/"+s.Name, natRoutes[s.Zone%nats]
+		if s.Public {
+			name, routes = "gw/"+s.Name, gwRoutes
+		}
+
+		_, err = ec2.NewRouteTableAssociation(ctx, name, &ec2.RouteTableAssociationArgs{
+			SubnetId:     v.Subnets[s.Name].ID(),
+			RouteTableId: routes.ID(),
+		}, pulumi.Parent(routes))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Per the guide linked below, the routing table with the NAT
+	// gateway should be the main table.
+	//
+	// https://docs.aws.amazon.com/vpc/latest/userguide/VPC_Scenario2.html
+	_, err = ec2.NewMainRouteTableAssociation(ctx, "main", &ec2.MainRouteTableAssociationArgs{
+		VpcId:        vpc.ID(),
+		RouteTableId: natRoutes[0].ID(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return v, nil
+}
+
+// newNAT creates the NAT gateway for zone z, and returns the route
+// table for the private subnets that use it.
+func (v *VPC) newNAT(ctx *pulumi.Context, n *Network, z int) (*ec2.RouteTable, error) {
+	suffix := ""
+	if z > 0 {
+		suffix = fmt.Sprintf("-%d", z)
+	}
+
+	private := v.Subnets[n.Private(z).Name]
+
+	natEIP, err := ec2.NewEip(ctx, "eip/nat"+suffix, &ec2.EipArgs{
+		Vpc:  pulumi.Bool(true),
+		Tags: NameTags(ctx, "nat-eip"+suffix),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The NAT gateway has to be in a public subnet so it can use the
+	// internet gateway there to get out.
+	nat, err := ec2.NewNatGateway(ctx, "nat"+suffix, &ec2.NatGatewayArgs{
+		AllocationId:     natEIP.ID(),
+		SubnetId:         v.Subnets[n.Public(z).Name].ID(),
+		ConnectivityType: pulumi.String("public"),
+		Tags:             NameTags(ctx, "nat"+suffix),
+	}, pulumi.Parent(private))
+	if err != nil {
+		return nil, err
+	}
+
+	return ec2.NewRouteTable(ctx, "routes/nat"+suffix, &ec2.RouteTableArgs{
+		VpcId: v.Vpc.ID(),
+		Routes: ec2.RouteTableRouteArray{
+			&ec2.RouteTableRouteArgs{
+				CidrBlock:    pulumi.String("0.0.0.0/0"),
+				NatGatewayId: nat.ID(),
+			},
+		},
+		Tags: NameTags(ctx, "nat-routes"+suffix),
+	}, pulumi.Parent(private))
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi/config"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/jpeach/pulumi-stacks/pkg/conf"
+	"github.com/jpeach/pulumi-stacks/pkg/probe"
+)
+
+// WaitOptions configures waiting for SSH to be ready on the hosts.
+type WaitOptions struct {
+	// Mode is "fail" to fail the update if a host is not ready, or
+	// "warn" to just warn about it. If it is empty, the update doesn't
+	// wait.
+	Mode string
+	// Timeout is how long to wait for all the hosts.
+	Timeout time.Duration
+}
+
+// NewWaitOptions reads the wait options from the "ssh" config namespace.
+func NewWaitOptions(ctx *pulumi.Context) (*WaitOptions, error) {
+	sshOpts := config.New(ctx, "ssh")
+
+	opts := &WaitOptions{
+		Mode:    sshOpts.Get("wait"),
+		Timeout: 5 * time.Minute,
+	}
+
+	switch opts.Mode {
+	case "", "fail", "warn":
+	default:
+		return nil, fmt.Errorf("invalid ssh:wait mode %q", opts.Mode)
+	}
+
+	if v := sshOpts.Get("waitTimeout"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ssh:waitTimeout: %w", err)
+		}
+
+		opts.Timeout = d
+	}
+
+	return opts, nil
+}
+
+// ProbeTarget returns the probe target for the host entry. If the host
+// key is pinned, the probe verifies it.
+func ProbeTarget(e conf.Entry, hostKey ssh.PublicKey) probe.Target {
+	address := e.Address
+	if e.Port != 0 {
+		address = net.JoinHostPort(address, strconv.Itoa(e.Port))
+	}
+
+	return probe.Target{
+		Name:    e.Name,
+		Address: address,
+		User:    e.User,
+		HostKey: hostKey,
+	}
+}
+
+// Readiness collects the hosts to wait for.
+type Readiness struct {
+	opts       *WaitOptions
+	topology   *Topology
+	identities []*Identity
+	bastionKey ssh.PublicKey
+	targets    []probe.Target
+	deps       []interface{}
+}
+
+// NewReadiness returns a Readiness that waits for the stack hosts,
+// using the topology and identities that the SSH config uses.
+func NewReadiness(opts *WaitOptions, topology *Topology, identities []*Identity) *Readiness {
+	return &Readiness{
+		opts:       opts,
+		topology:   topology,
+		identities: identities,
+	}
+}
+
+// AddWorkload adds a workload host. The wait doesn't start until the
+// instance exists.
+func (r *Readiness) AddWorkload(e conf.Entry, hostKey ssh.PublicKey, instance pulumi.CustomResource) {
+	r.targets = append(r.targets, ProbeTarget(e, hostKey))
+	r.deps = append(r.deps, instance.ID())
+}
+
+// AddDependency delays the wait until the resource exists, such as the
+// DNS record that a host is reached by.
+func (r *Readiness) AddDependency(res pulumi.CustomResource) {
+	r.deps = append(r.deps, res.ID())
+}
+
+// Wait waits for the bastion at address, then for each workload host
+// through the bastion. The status of each host is exported as
+// "ssh.ready". In "fail" mode, the update fails if any of the hosts
+// are not ready. Nothing happens during a preview, since the hosts
+// don't exist yet.
+func (r *Readiness) Wait(ctx *pulumi.Context, address pulumi.StringOutput, hostKey ssh.PublicKey) {
+	if r.opts.Mode == "" {
+		return
+	}
+
+	// The probes can't go through Session Manager or external jump
+	// hosts.
+	if r.topology.Access == AccessSSM {
+		_ = ctx.Log.Warn("not waiting for SSH, since the hosts are reached through Session Manager", nil)
+		return
+	}
+
+	if len(r.topology.JumpHosts) > 0 {
+		_ = ctx.Log.Warn("not waiting for SSH, since the hosts are reached through ssh:jumpHosts", nil)
+		return
+	}
+
+	var signers []ssh.Signer
+	for _, i := range r.identities {
+		signers = append(signers, i.Signer)
+	}
+
+	opts := probe.DefaultOptions(signers...)
+	opts.Timeout = r.opts.Timeout
+
+	args := append([]interface{}{address}, r.deps...)
+
+	ready := pulumi.All(args...).ApplyT(func(args []interface{}) (map[string]string, error) {
+		var bastion *probe.Target
+		if !r.topology.Direct {
+			t := ProbeTarget(r.topology.Bastion(args[0].(string)), hostKey)
+			bastion = &t
+		}
+
+		statuses := probe.Wait(context.Background(), bastion, r.targets, opts)
+
+		result := map[string]string{}
+		for _, s := range statuses {
+			_ = ctx.Log.Info(s.String(), nil)
+			result[s.Name] = "ready"
+			if !s.Ready {
+				result[s.Name] = s.Err.Error()
+			}
+		}
+
+		failed := probe.Failed(statuses)
+		if len(failed) == 0 {
+			return result, nil
+		}
+
+		var names []string
+		for _, s := range failed {
+			names = append(names, s.Name)
+		}
+
+		msg := fmt.Sprintf("SSH is not ready on %s", strings.Join(names, ", "))
+		if r.opts.Mode == "fail" {
+			return nil, fmt.Errorf("%s", msg)
+		}
+
+		_ = ctx.Log.Warn(msg, nil)
+		return result, nil
+	}).(pulumi.StringMapOutput)
+
+	ctx.Export("ssh.ready", ready)
+}
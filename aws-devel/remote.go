@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pulumi/pulumi-command/sdk/go/command/local"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi/config"
+
+	"github.com/jpeach/pulumi-stacks/pkg/conf"
+	"github.com/jpeach/pulumi-stacks/pkg/remote"
+)
+
+// AuthorizedKeysStepName is the name of the step that installs the
+// stack identities on the hosts, see AuthorizedKeysStep.
+const AuthorizedKeysStepName = "authorized-keys"
+
+// Remote runs the provisioning steps from the "remote" config
+// namespace on the stack hosts.
+type Remote struct {
+	steps   []remote.Step
+	timeout time.Duration
+	sshConf *conf.SSH
+	// installed are the commands that ran the authorized keys step.
+	installed []pulumi.Resource
+}
+
+// NewRemote reads the provisioning steps. The builtin steps run on each
+// host before the configured steps.
+func NewRemote(ctx *pulumi.Context, sshConf *conf.SSH, builtin ...remote.Step) (*Remote, error) {
+	remoteOpts := config.New(ctx, "remote")
+
+	r := &Remote{
+		timeout: 5 * time.Minute,
+		sshConf: sshConf,
+	}
+
+	if err := remoteOpts.GetObject("steps", &r.steps); err != nil {
+		return nil, fmt.Errorf("invalid remote:steps: %w", err)
+	}
+
+	names := map[string]bool{}
+	for i := range r.steps {
+		if err := r.steps[i].Validate(); err != nil {
+			return nil, fmt.Errorf("invalid remote:steps: %w", err)
+		}
+
+		if r.steps[i].Name == AuthorizedKeysStepName {
+			return nil, fmt.Errorf("invalid remote:steps: step name %q is reserved", r.steps[i].Name)
+		}
+
+		if names[r.steps[i].Name] {
+			return nil, fmt.Errorf("invalid remote:steps: duplicate step %q", r.steps[i].Name)
+		}
+
+		names[r.steps[i].Name] = true
+
+		if len(r.steps[i].Hosts) == 0 {
+			r.steps[i].Hosts = []string{"workload"}
+		}
+	}
+
+	r.steps = append(builtin, r.steps...)
+
+	if v := remoteOpts.Get("timeout"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid remote:timeout: %w", err)
+		}
+
+		r.timeout = d
+	}
+
+	return r, nil
+}
+
+// Run runs the steps for the host in order, once the instance exists.
+// A step runs again when it changes, or when the instance is replaced.
+// The steps get the env variables, so they wait until the variables
+// resolve, which is when the SSH config has the entries that the steps
+// connect through, e.g. the bastion entry.
+func (r *Remote) Run(ctx *pulumi.Context, host conf.Entry, instance pulumi.CustomResource, env pulumi.StringMap) error {
+	alias := r.sshConf.Alias(host.Name)
+	wait := remote.WaitCommand(r.sshConf.Path(), alias, r.timeout)
+
+	var previous pulumi.Resource = instance
+
+	for _, step := range r.steps {
+		if !step.Matches(host.Name, host.Groups) {
+			continue
+		}
+
+		inv, err := step.Invocation(r.sshConf.Path(), alias)
+		if err != nil {
+			return err
+		}
+
+		args := &local.CommandArgs{
+			Create:      pulumi.String(wait + "\n" + inv.Command),
+			Environment: env,
+			Triggers: pulumi.Array{
+				pulumi.String(inv.Digest),
+				instance.ID(),
+			},
+		}
+
+		if inv.Stdin != "" {
+			args.Stdin = pulumi.String(inv.Stdin)
+		}
+
+		cmd, err := local.NewCommand(ctx, fmt.Sprintf("remote/%s/%s", host.Name, step.Name), args,
+			pulumi.DependsOn([]pulumi.Resource{previous}))
+		if err != nil {
+			return err
+		}
+
+		previous = cmd
+
+		if step.Name == AuthorizedKeysStepName {
+			r.installed = append(r.installed, cmd)
+		}
+	}
+
+	return nil
+}
+
+// Installed returns the commands that installed the stack identities on
+// the hosts.
+func (r *Remote) Installed() []pulumi.Resource {
+	return r.installed
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pulumi/pulumi-aws/sdk/v5/go/aws/ec2"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi/config"
+	"inet.af/netaddr"
+
+	"github.com/jpeach/pulumi-stacks/pkg/ingress"
+)
+
+// Rule is an ingress rule of a security group. The traffic is allowed
+// from the source ranges, from the source groups, and from the group
+// itself if Self is true.
+type Rule struct {
+	Description string
+	// Protocol is "tcp", "udp", "icmp", or "-1" for all protocols.
+	Protocol string
+	FromPort int
+	ToPort   int
+	Sources  []netaddr.IPPrefix
+	// Groups are the names of the source groups.
+	Groups []string
+	Self   bool
+}
+
+// ParsePorts parses a port range for a rule, in the form
+// "[protocol/]port[-port]". The protocol defaults to "tcp". The range
+// "all" is all protocols and ports, and "icmp" is all ICMP traffic.
+func ParsePorts(s string) (Rule, error) {
+	switch s {
+	case "all":
+		return Rule{Protocol: "-1"}, nil
+	case "icmp":
+		return Rule{Protocol: "icmp", FromPort: -1, ToPort: -1}, nil
+	}
+
+	r := Rule{Protocol: "tcp"}
+
+	ports := s
+	if i := strings.Index(s, "/"); i >= 0 {
+		r.Protocol, ports = s[:i], s[i+1:]
+	}
+
+	if r.Protocol != "tcp" && r.Protocol != "udp" {
+		return Rule{}, fmt.Errorf("invalid protocol in %q, must be tcp or udp", s)
+	}
+
+	from, to := ports, ports
+	if i := strings.Index(ports, "-"); i >= 0 {
+		from, to = ports[:i], ports[i+1:]
+	}
+
+	var err error
+	if r.FromPort, err = strconv.Atoi(from); err != nil {
+		return Rule{}, fmt.Errorf("invalid port in %q", s)
+	}
+
+	if r.ToPort, err = strconv.Atoi(to); err != nil {
+		return Rule{}, fmt.Errorf("invalid port in %q", s)
+	}
+
+	if r.FromPort < 1 || r.ToPort > 65535 || r.FromPort > r.ToPort {
+		return Rule{}, fmt.Errorf("invalid port range in %q", s)
+	}
+
+	return r, nil
+}
+
+// ServiceProfiles are named sets of port ranges for services that run
+// on the workload instances.
+var ServiceProfiles = map[string][]string{
+	// https://kubernetes.io/docs/reference/networking/ports-and-protocols/
+	"kubernetes": {"6443", "2379-2380", "10250", "10257", "10259", "30000-32767"},
+	// The Kuma control plane webhook, MADS, xDS, diagnostics, API and
+	// KDS ports.
+	"kuma": {"5443", "5676", "5678", "5680", "5681", "5682", "5685"},
+	"http": {"80", "443"},
+}
+
+// SecGroup declares a security group. All outbound traffic is allowed.
+type SecGroup struct {
+	// Name is the name of the group in SecurityGroups.
+	Name    string
+	Ingress []Rule
+}
+
+// IngressConfig is an extra ingress rule for the workload instances.
+type IngressConfig struct {
+	Description string   `json:"description,omitempty"`
+	Ports       string   `json:"ports"`
+	From        []string `json:"from"`
+}
+
+// NewSecGroups returns the security groups to create, reading the
+// workload rules from the "workload" config namespace.
+//
+// The bastion allows SSH from the SSH sources. The workload instances
+// allow SSH from the bastion, the workload:ports traffic from each
+// other, and the workload:services traffic from the VPC. If sshSources
+// is nil, there is no bastion.
+//
+// If wg is not nil, the bastion also allows WireGuard from the SSH
+// sources, and the workload instances allow any traffic from the bastion,
+// which masquerades the WireGuard clients.
+func NewSecGroups(ctx *pulumi.Context, n *Network, sshSources *ingress.Sources, wg *WireGuard) ([]SecGroup, error) {
+	workloadConf := config.New(ctx, "workload")
+
+	var groups []SecGroup
+	workload := SecGroup{Name: "Workload"}
+
+	if sshSources != nil {
+		bastion := SecGroup{
+			Name: "Bastion",
+			Ingress: []Rule{{
+				Description: "SSH",
+				Protocol:    "tcp",
+				FromPort:    22,
+				ToPort:      22,
+				Sources:     sshSources.IPv4,
+			}},
+		}
+
+		workload.Ingress = append(workload.Ingress, Rule{
+			Description: "SSH from the bastion",
+			Protocol:    "tcp",
+			FromPort:    22,
+			ToPort:      22,
+			Groups:      []string{"Bastion"},
+		})
+
+		if wg != nil {
+			bastion.Ingress = append(bastion.Ingress, Rule{
+				Description: "WireGuard",
+				Protocol:    "udp",
+				FromPort:    wg.Port,
+				ToPort:      wg.Port,
+				Sources:     sshSources.IPv4,
+			})
+
+			workload.Ingress = append(workload.Ingress, Rule{
+				Description: "WireGuard clients",
+				Protocol:    "-1",
+				Groups:      []string{"Bastion"},
+			})
+		}
+
+		groups = append(groups, bastion)
+	}
+
+	var ports []string
+	if err := workloadConf.GetObject("ports", &ports); err != nil {
+		return nil, fmt.Errorf("invalid workload:ports: %w", err)
+	}
+
+	if ports == nil {
+		ports = []string{"all"}
+	}
+
+	for _, p := range ports {
+		r, err := ParsePorts(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid workload:ports: %w", err)
+		}
+
+		r.Description = "Workload " + p
+		r.Self = true
+		workload.Ingress = append(workload.Ingress, r)
+	}
+
+	var services []string
+	if err := workloadConf.GetObject("services", &services); err != nil {
+		return nil, fmt.Errorf("invalid workload:services: %w", err)
+	}
+
+	for _, s := range services {
+		profile, ok := ServiceProfiles[s]
+		if !ok {
+			var names []string
+			for n := range ServiceProfiles {
+				names = append(names, n)
+			}
+
+			sort.Strings(names)
+			return nil, fmt.Errorf("invalid workload:services %q, must be one of %s",
+				s, strings.Join(names, ", "))
+		}
+
+		for _, p := range profile {
+			r, err := ParsePorts(p)
+			if err != nil {
+				return nil, err
+			}
+
+			r.Description = fmt.Sprintf("%s %s", s, p)
+			r.Sources = []netaddr.IPPrefix{n.VPC}
+			workload.Ingress = append(workload.Ingress, r)
+		}
+	}
+
+	var extra []IngressConfig
+	if err := workloadConf.GetObject("ingress", &extra); err != nil {
+		return nil, fmt.Errorf("invalid workload:ingress: %w", err)
+	}
+
+	for _, e := range extra {
+		r, err := ParsePorts(e.Ports)
+		if err != nil {
+			return nil, fmt.Errorf("invalid workload:ingress: %w", err)
+		}
+
+		if len(e.From) == 0 {
+			return nil, fmt.Errorf("invalid workload:ingress: no sources for %q", e.Ports)
+		}
+
+		// The sources are given like ssh:allowFrom.
+		sources, err := ParseSources(ctx, "workload:ingress", e.From)
+		if err != nil {
+			return nil, err
+		}
+
+		r.Sources = sources.IPv4
+
+		r.Description = e.Description
+		workload.Ingress = append(workload.Ingress, r)
+	}
+
+	return append(groups, workload), nil
+}
+
+// ingressArgs returns the arguments for an ingress rule.
+func ingressArgs(r Rule) (*ec2.SecurityGroupIngressArgs, error) {
+	args := &ec2.SecurityGroupIngressArgs{
+		Protocol: pulumi.String(r.Protocol),
+		FromPort: pulumi.Int(r.FromPort),
+		ToPort:   pulumi.Int(r.ToPort),
+	}
+
+	if r.Description != "" {
+		args.Description = pulumi.String(r.Description)
+	}
+
+	if len(r.Sources) > 0 {
+		args.CidrBlocks = pulumi.ToStringArray(ingress.Strings(r.Sources))
+	}
+
+	if len(r.Groups) > 0 {
+		var ids pulumi.StringArray
+		for _, g := range r.Groups {
+			grp, ok := SecurityGroups[g]
+			if !ok {
+				return nil, fmt.Errorf("rule %q: unknown security group %q", r.Description, g)
+			}
+
+			ids = append(ids, grp.ID().ToStringOutput())
+		}
+
+		args.SecurityGroups = ids
+	}
+
+	if r.Self {
+		args.Self = pulumi.Bool(true)
+	}
+
+	return args, nil
+}
+
+// InitSecurityGroups creates the security groups in order, so a rule
+// can only refer to the groups before it.
+func InitSecurityGroups(ctx *pulumi.Context, vpc *ec2.Vpc, groups []SecGroup) error {
+	for _, g := range groups {
+		var rules ec2.SecurityGroupIngressArray
+		for _, r := range g.Ingress {
+			args, err := ingressArgs(r)
+			if err != nil {
+				return fmt.Errorf("security group %q: %w", g.Name, err)
+			}
+
+			rules = append(rules, args)
+		}
+
+		name := strings.ToLower(g.Name)
+
+		grp, err := ec2.NewSecurityGroup(ctx, name, &ec2.SecurityGroupArgs{
+			VpcId:   vpc.ID(),
+			Ingress: rules,
+			// Allow any outbound.
+			Egress: &ec2.SecurityGroupEgressArray{
+				&ec2.SecurityGroupEgressArgs{
+					CidrBlocks: pulumi.StringArray{
+						pulumi.String("0.0.0.0/0"),
+					},
+					FromPort: pulumi.Int(0),
+					ToPort:   pulumi.Int(0),
+					Protocol: pulumi.String("-1"),
+				},
+			},
+			Tags: NameTags(ctx, "sec", name),
+		})
+		if err != nil {
+			return err
+		}
+
+		SecurityGroups[g.Name] = grp
+	}
+
+	return nil
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+	"inet.af/netaddr"
+
+	"github.com/jpeach/pulumi-stacks/pkg/ingress"
+)
+
+// mocks stands in for the Pulumi engine, for tests that only read the
+// stack config.
+type mocks struct{}
+
+func (mocks) NewResource(args pulumi.MockResourceArgs) (string, resource.PropertyMap, error) {
+	return args.Name + "_id", args.Inputs, nil
+}
+
+func (mocks) Call(args pulumi.MockCallArgs) (resource.PropertyMap, error) {
+	return resource.PropertyMap{}, nil
+}
+
+// withConfig runs f in a program with the given stack config.
+func withConfig(t *testing.T, cfg map[string]string, f func(ctx *pulumi.Context) error) error {
+	t.Helper()
+
+	return pulumi.RunErr(f, pulumi.WithMocks("aws-devel", "test", mocks{}), func(ri *pulumi.RunInfo) {
+		ri.Config = cfg
+	})
+}
+
+func TestParsePorts(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Rule
+		err  string
+	}{
+		{"all", Rule{Protocol: "-1"}, ""},
+		{"icmp", Rule{Protocol: "icmp", FromPort: -1, ToPort: -1}, ""},
+		{"443", Rule{Protocol: "tcp", FromPort: 443, ToPort: 443}, ""},
+		{"tcp/7000-7100", Rule{Protocol: "tcp", FromPort: 7000, ToPort: 7100}, ""},
+		{"udp/8472", Rule{Protocol: "udp", FromPort: 8472, ToPort: 8472}, ""},
+		{"1-65535", Rule{Protocol: "tcp", FromPort: 1, ToPort: 65535}, ""},
+		{"sctp/9", Rule{}, "invalid protocol"},
+		{"icmp/8", Rule{}, "invalid protocol"},
+		{"http", Rule{}, "invalid port"},
+		{"80-", Rule{}, "invalid port"},
+		{"0", Rule{}, "invalid port range"},
+		{"65536", Rule{}, "invalid port range"},
+		{"100-10", Rule{}, "invalid port range"},
+	}
+
+	for _, tt := range tests {
+		got, err := ParsePorts(tt.in)
+
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%q: got %+v, %v, want error %q", tt.in, got, err, tt.err)
+			}
+
+			continue
+		}
+
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: got %+v, %v, want %+v", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+// ruleSummary describes a rule as "description protocol/from-to sources".
+func ruleSummary(r Rule) string {
+	s := []string{r.Description, fmt.Sprintf("%s/%d-%d", r.Protocol, r.FromPort, r.ToPort)}
+	s = append(s, ingress.Strings(r.Sources)...)
+	s = append(s, r.Groups...)
+
+	if r.Self {
+		s = append(s, "self")
+	}
+
+	return strings.Join(s, " ")
+}
+
+func TestNewSecGroups(t *testing.T) {
+	n := &Network{VPC: netaddr.MustParseIPPrefix("172.16.0.0/16")}
+	sshSources := &ingress.Sources{
+		IPv4: []netaddr.IPPrefix{netaddr.MustParseIPPrefix("198.51.100.0/24")},
+	}
+
+	tests := []struct {
+		name       string
+		cfg        map[string]string
+		sshSources *ingress.Sources
+		wg         *WireGuard
+		want       map[string][]string
+		err        string
+	}{{
+		name: "defaults without a bastion",
+		want: map[string][]string{
+			"Workload": {"Workload all -1/0-0 self"},
+		},
+	}, {
+		name:       "bastion",
+		sshSources: sshSources,
+		want: map[string][]string{
+			"Bastion": {"SSH tcp/22-22 198.51.100.0/24"},
+			"Workload": {
+				"SSH from the bastion tcp/22-22 Bastion",
+				"Workload all -1/0-0 self",
+			},
+		},
+	}, {
+		name:       "wireguard",
+		sshSources: sshSources,
+		wg:         &WireGuard{Port: 51820},
+		want: map[string][]string{
+			"Bastion": {
+				"SSH tcp/22-22 198.51.100.0/24",
+				"WireGuard udp/51820-51820 198.51.100.0/24",
+			},
+			"Workload": {
+				"SSH from the bastion tcp/22-22 Bastion",
+				"WireGuard clients -1/0-0 Bastion",
+				"Workload all -1/0-0 self",
+			},
+		},
+	}, {
+		name: "ports, services and ingress",
+		cfg: map[string]string{
+			"workload:ports":    `["udp/8472", "7000-7100"]`,
+			"workload:services": `["http"]`,
+			"workload:ingress":  `[{"description": "VPN", "ports": "all", "from": ["10.99.0.0/24", "10.98.0.1"]}]`,
+		},
+		want: map[string][]string{
+			"Workload": {
+				"Workload udp/8472 udp/8472-8472 self",
+				"Workload 7000-7100 tcp/7000-7100 self",
+				"http 80 tcp/80-80 172.16.0.0/16",
+				"http 443 tcp/443-443 172.16.0.0/16",
+				"VPN -1/0-0 10.99.0.0/24 10.98.0.1/32",
+			},
+		},
+	}, {
+		name: "invalid port",
+		cfg:  map[string]string{"workload:ports": `["tcp/x"]`},
+		err:  `invalid workload:ports: invalid port in "tcp/x"`,
+	}, {
+		name: "unknown service",
+		cfg:  map[string]string{"workload:services": `["ftp"]`},
+		err:  `invalid workload:services "ftp", must be one of http, kubernetes, kuma`,
+	}, {
+		name: "ingress without sources",
+		cfg:  map[string]string{"workload:ingress": `[{"ports": "443"}]`},
+		err:  `invalid workload:ingress: no sources for "443"`,
+	}, {
+		name: "ingress with an unmasked range",
+		cfg:  map[string]string{"workload:ingress": `[{"ports": "443", "from": ["10.99.0.1/24"]}]`},
+		err:  "did you mean 10.99.0.0/24?",
+	}, {
+		name: "ingress from IPv6",
+		cfg:  map[string]string{"workload:ingress": `[{"ports": "443", "from": ["10.99.0.0/24", "2001:db8::/32"]}]`},
+		err:  "invalid workload:ingress: the stack has no IPv6 addresses, so 2001:db8::/32 can't connect",
+	}, {
+		name: "ingress with an invalid port",
+		cfg:  map[string]string{"workload:ingress": `[{"ports": "udp/", "from": ["10.99.0.0/24"]}]`},
+		err:  `invalid workload:ingress: invalid port in "udp/"`,
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var groups []SecGroup
+
+			err := withConfig(t, tt.cfg, func(ctx *pulumi.Context) error {
+				var err error
+				groups, err = NewSecGroups(ctx, n, tt.sshSources, tt.wg)
+				return err
+			})
+
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got %v, want error %q", err, tt.err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := map[string][]string{}
+			for _, g := range groups {
+				for _, r := range g.Ingress {
+					got[g.Name] = append(got[g.Name], ruleSummary(r))
+				}
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+
+			// The groups are created in order, and the workload
+			// group refers to the bastion group.
+			if groups[len(groups)-1].Name != "Workload" {
+				t.Errorf("the workload group isn't last")
+			}
+		})
+	}
+}
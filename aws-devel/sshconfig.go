@@ -0,0 +1,28 @@
+package main
+
+import (
+	"github.com/pulumi/pulumi-command/sdk/go/command/local"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+
+	"github.com/jpeach/pulumi-stacks/pkg/conf"
+)
+
+// TrackSSHConfig registers a command resource that owns the SSH config
+// files, so that they are removed when the stack is destroyed. The
+// program writes the files as the hosts come up, so the resource only
+// records a digest of them once written resolves, so that updates to
+// the files show up in the stack history.
+func TrackSSHConfig(ctx *pulumi.Context, sshConf *conf.SSH, written pulumi.StringOutput) error {
+	digest := written.ApplyT(func(string) string {
+		return sshConf.Digest()
+	}).(pulumi.StringOutput)
+
+	_, err := local.NewCommand(ctx, "ssh/config", &local.CommandArgs{
+		Delete: pulumi.String(sshConf.RemoveCommand()),
+		Environment: pulumi.StringMap{
+			"SSH_CONFIG_DIGEST": digest,
+		},
+	})
+
+	return err
+}
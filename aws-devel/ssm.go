@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/pulumi/pulumi-aws/sdk/v5/go/aws/iam"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+
+	"github.com/jpeach/pulumi-stacks/pkg/cloudinit"
+)
+
+// SSMPolicyARN is the managed policy that lets the Systems Manager agent
+// register the instance and accept sessions.
+const SSMPolicyARN = "arn:aws:iam::aws:policy/AmazonSSMManagedInstanceCore"
+
+// ssmAssumeRolePolicy lets EC2 instances assume the role.
+const ssmAssumeRolePolicy = `{
+  "Version": "2012-10-17",
+  "Statement": [
+    {
+      "Effect": "Allow",
+      "Principal": {"Service": "ec2.amazonaws.com"},
+      "Action": "sts:AssumeRole"
+    }
+  ]
+}`
+
+// NewSSMInstanceProfile creates an instance profile with a role that
+// has the SSMPolicyARN policy.
+func NewSSMInstanceProfile(ctx *pulumi.Context) (*iam.InstanceProfile, error) {
+	role, err := iam.NewRole(ctx, "ssm", &iam.RoleArgs{
+		AssumeRolePolicy: pulumi.String(ssmAssumeRolePolicy),
+		Tags:             NameTags(ctx, "ssm"),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = iam.NewRolePolicyAttachment(ctx, "ssm", &iam.RolePolicyAttachmentArgs{
+		Role:      role.Name,
+		PolicyArn: pulumi.String(SSMPolicyARN),
+	}, pulumi.Parent(role))
+	if err != nil {
+		return nil, err
+	}
+
+	return iam.NewInstanceProfile(ctx, "ssm", &iam.InstanceProfileArgs{
+		Role: role.Name,
+		Tags: NameTags(ctx, "ssm"),
+	}, pulumi.Parent(role))
+}
+
+// AddSSMAgent adds commands to install and start the Systems Manager
+// agent to the user data, unless the image already runs it. The agent
+// is installed from the RPM package, which suits the Fedora images.
+func AddSSMAgent(userData *cloudinit.Config, image *Image) error {
+	if image.SSMAgent {
+		return nil
+	}
+
+	var platform string
+	switch image.Architecture {
+	case "x86_64":
+		platform = "linux_amd64"
+	case "arm64":
+		platform = "linux_arm64"
+	default:
+		return fmt.Errorf("no Systems Manager agent for %s images", image.Architecture)
+	}
+
+	userData.RunCmd = append(userData.RunCmd,
+		fmt.Sprintf("dnf install -y https://s3.amazonaws.com/ec2-downloads-windows/SSMAgent/latest/%s/amazon-ssm-agent.rpm", platform),
+		"systemctl enable --now amazon-ssm-agent",
+	)
+
+	return nil
+}
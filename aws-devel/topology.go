@@ -0,0 +1,348 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi/config"
+
+	"github.com/jpeach/pulumi-stacks/pkg/conf"
+)
+
+// JumpHost is a host outside the stack that SSH sessions jump through
+// to reach the bastion, e.g. a corporate jump box.
+type JumpHost struct {
+	Name     string `json:"name"`
+	Hostname string `json:"hostname"`
+	User     string `json:"user,omitempty"`
+	Port     int    `json:"port,omitempty"`
+}
+
+// HostOptions are SSH client options for a stack host. Durations are
+// strings such as "30s".
+type HostOptions struct {
+	User                string   `json:"user,omitempty"`
+	Port                int      `json:"port,omitempty"`
+	ControlPersist      string   `json:"controlPersist,omitempty"`
+	ServerAliveInterval string   `json:"serverAliveInterval,omitempty"`
+	LocalForwards       []string `json:"localForwards,omitempty"`
+	RemoteForwards      []string `json:"remoteForwards,omitempty"`
+	DynamicForwards     []string `json:"dynamicForwards,omitempty"`
+}
+
+// apply sets the options that are given on the entry.
+func (o HostOptions) apply(e *conf.Entry) error {
+	if o.User != "" {
+		e.User = o.User
+	}
+
+	if o.Port != 0 {
+		e.Port = o.Port
+	}
+
+	if o.ControlPersist != "" {
+		d, err := parseSSHTime(o.ControlPersist)
+		if err != nil {
+			return fmt.Errorf("invalid controlPersist: %w", err)
+		}
+
+		e.ControlPersist = d
+	}
+
+	if o.ServerAliveInterval != "" {
+		d, err := parseSSHTime(o.ServerAliveInterval)
+		if err != nil {
+			return fmt.Errorf("invalid serverAliveInterval: %w", err)
+		}
+
+		e.ServerAliveInterval = d
+	}
+
+	if len(o.LocalForwards) > 0 {
+		e.LocalForwards = o.LocalForwards
+	}
+
+	if len(o.RemoteForwards) > 0 {
+		e.RemoteForwards = o.RemoteForwards
+	}
+
+	if len(o.DynamicForwards) > 0 {
+		e.DynamicForwards = o.DynamicForwards
+	}
+
+	return nil
+}
+
+// parseSSHTime parses a duration for a ssh_config(5) time option, which
+// counts whole seconds. A zero time means something else to SSH, e.g.
+// that a shared connection stays open forever, so the duration must be
+// at least a second.
+func parseSSHTime(s string) (time.Duration, error) {
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+
+	if d < time.Second || d%time.Second != 0 {
+		return 0, fmt.Errorf("%q is not a whole number of seconds, of at least 1s", s)
+	}
+
+	return d, nil
+}
+
+// Access modes select how SSH reaches the workload hosts.
+const (
+	// AccessBastion reaches the workload hosts through a bastion host.
+	AccessBastion = "bastion"
+	// AccessSSM reaches the workload hosts through AWS Systems Manager
+	// Session Manager, so no bastion or inbound SSH port is needed.
+	AccessSSM = "ssm"
+)
+
+// NewAccessMode reads the access mode from ssh:access. The default is
+// AccessBastion.
+func NewAccessMode(ctx *pulumi.Context) (string, error) {
+	switch mode := config.New(ctx, "ssh").Get("access"); mode {
+	case "":
+		return AccessBastion, nil
+	case AccessBastion, AccessSSM:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("invalid ssh:access %q, must be %q or %q", mode, AccessBastion, AccessSSM)
+	}
+}
+
+// SSMProxyCommand returns the ProxyCommand that starts a Session Manager
+// SSH session to the instance whose ID is the host name. If region is
+// empty, the AWS CLI uses its default region.
+func SSMProxyCommand(region string) string {
+	cmd := "aws ssm start-session --target %h --document-name AWS-StartSSHSession --parameters portNumber=%p"
+	if region != "" {
+		cmd += " --region " + region
+	}
+
+	return cmd
+}
+
+// Topology describes how SSH reaches the stack hosts.
+type Topology struct {
+	// Access is the access mode.
+	Access string
+	// ProxyCommand is the command that SSH uses to reach the workload
+	// hosts in the AccessSSM mode.
+	ProxyCommand string
+	// JumpHosts are the hosts to jump through to reach the bastion,
+	// in order.
+	JumpHosts []JumpHost
+	// Direct is true if the workload hosts are reachable without
+	// going through the bastion, e.g. over a VPN.
+	Direct bool
+	// Domain is the private DNS zone of the stack hosts. The workload
+	// hosts that are reached through the bastion are named in it,
+	// since the bastion resolves the names.
+	Domain string
+	// Identities are the identity files for the stack hosts.
+	Identities []string
+	// User is the login user for the stack hosts.
+	User string
+	// Options are the SSH options for the stack hosts, keyed by host
+	// name. The options for "*" apply to all the stack hosts.
+	Options map[string]HostOptions
+}
+
+// NewTopology reads the SSH topology from the "ssh" config namespace.
+// The login user for the stack hosts is the user for the image.
+func NewTopology(ctx *pulumi.Context, image *Image, identities []string) (*Topology, error) {
+	sshOpts := config.New(ctx, "ssh")
+
+	access, err := NewAccessMode(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &Topology{
+		Access:     access,
+		Direct:     sshOpts.GetBool("direct"),
+		Identities: identities,
+		User:       image.User,
+	}
+
+	if t.Domain, err = NewDomain(ctx); err != nil {
+		return nil, err
+	}
+
+	if access == AccessSSM {
+		t.ProxyCommand = SSMProxyCommand(config.New(ctx, "aws").Get("region"))
+	}
+
+	if err := sshOpts.GetObject("hostOptions", &t.Options); err != nil {
+		return nil, fmt.Errorf("invalid ssh:hostOptions: %w", err)
+	}
+
+	// Check the options up front, rather than when the hosts are
+	// written.
+	for name, o := range t.Options {
+		if err := o.apply(&conf.Entry{}); err != nil {
+			return nil, fmt.Errorf("invalid ssh:hostOptions for %q: %w", name, err)
+		}
+
+		// Only the bastion's connections are shared, see Bastion.
+		if o.ControlPersist != "" && name != "*" && name != "bastion" {
+			return nil, fmt.Errorf("invalid ssh:hostOptions for %q: controlPersist only applies to the bastion", name)
+		}
+	}
+
+	if err := sshOpts.GetObject("jumpHosts", &t.JumpHosts); err != nil {
+		return nil, fmt.Errorf("invalid ssh:jumpHosts: %w", err)
+	}
+
+	names := map[string]bool{}
+	for _, j := range t.JumpHosts {
+		switch {
+		case j.Name == "" || j.Hostname == "":
+			return nil, fmt.Errorf("invalid ssh:jumpHosts: name and hostname are required")
+		case j.Name == "bastion" || strings.HasPrefix(j.Name, "workload-"):
+			return nil, fmt.Errorf("invalid ssh:jumpHosts: %q is a stack host name", j.Name)
+		case names[j.Name]:
+			return nil, fmt.Errorf("invalid ssh:jumpHosts: duplicate name %q", j.Name)
+		}
+
+		names[j.Name] = true
+	}
+
+	if access == AccessSSM && (t.Direct || len(t.JumpHosts) > 0) {
+		return nil, fmt.Errorf("ssh:direct and ssh:jumpHosts can't be used with ssh:access %q", AccessSSM)
+	}
+
+	return t, nil
+}
+
+// jumps returns the names of the jump hosts.
+func (t *Topology) jumps() []string {
+	var names []string
+	for _, j := range t.JumpHosts {
+		names = append(names, j.Name)
+	}
+
+	return names
+}
+
+// WriteJumpHosts writes the entries for the jump hosts. These hosts
+// authenticate the user with their own identities.
+func (t *Topology) WriteJumpHosts(s *conf.SSH) error {
+	for i, j := range t.JumpHosts {
+		err := s.WriteHost(conf.Entry{
+			Name:      j.Name,
+			Address:   j.Hostname,
+			User:      j.User,
+			Port:      j.Port,
+			Jump:      t.jumps()[:i],
+			Multiplex: true,
+			External:  true,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// entry returns the entry for the named stack host, with the options
+// for all hosts and then the options for the host applied.
+func (t *Topology) entry(name string, address string) conf.Entry {
+	e := conf.Entry{
+		Name:       name,
+		Address:    address,
+		User:       t.User,
+		Identities: t.Identities,
+	}
+
+	// The options were checked by NewTopology.
+	_ = t.Options["*"].apply(&e)
+	_ = t.Options[name].apply(&e)
+
+	return e
+}
+
+// Bastion returns the entry for the bastion host, which is reached
+// through the jump hosts.
+func (t *Topology) Bastion(address string) conf.Entry {
+	e := t.entry("bastion", address)
+	e.Jump = t.jumps()
+	e.Multiplex = true
+	e.Groups = []string{"bastion"}
+
+	return e
+}
+
+// Workload returns the entry for a workload host in the given pool,
+// which is reached through the jump hosts and the bastion by its name in
+// the Domain, unless it is reachable directly at its address. In the
+// AccessSSM mode, the address is the instance ID, and the host is
+// reached through Session Manager.
+func (t *Topology) Workload(name string, address string, pool string) conf.Entry {
+	e := t.entry(name, address)
+	e.Groups = []string{"workload", "workload_" + groupName(pool)}
+
+	switch {
+	case t.Access == AccessSSM:
+		e.ProxyCommand = t.ProxyCommand
+	case !t.Direct:
+		e.Jump = append(t.jumps(), "bastion")
+		if t.Domain != "" {
+			e.Address = name + "." + t.Domain
+			e.Aliases = []string{address}
+		}
+	}
+
+	return e
+}
+
+// WorkloadPools returns the pool of each of the count workload
+// instances. The workload:pools list names the pool of each instance in
+// order, and the instances past the end of the list are in the
+// workload:pool pool.
+func WorkloadPools(ctx *pulumi.Context, count int) ([]string, error) {
+	workloadConf := config.New(ctx, "workload")
+
+	pool := workloadConf.Get("pool")
+	if pool == "" {
+		pool = "default"
+	}
+
+	var pools []string
+	if err := workloadConf.GetObject("pools", &pools); err != nil {
+		return nil, fmt.Errorf("invalid workload:pools: %w", err)
+	}
+
+	if len(pools) > count {
+		return nil, fmt.Errorf("invalid workload:pools: %d pools for %d instances", len(pools), count)
+	}
+
+	for i, p := range pools {
+		if p == "" {
+			return nil, fmt.Errorf("invalid workload:pools: no pool for workload-%d", i)
+		}
+	}
+
+	for len(pools) < count {
+		pools = append(pools, pool)
+	}
+
+	return pools, nil
+}
+
+// groupName converts name to a valid Ansible group name.
+func groupName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		default:
+			return '_'
+		}
+	}, name)
+}
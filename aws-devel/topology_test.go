@@ -0,0 +1,69 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+func TestWorkloadPools(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  map[string]string
+		want []string
+		err  string
+	}{{
+		name: "default",
+		want: []string{"default", "default", "default"},
+	}, {
+		name: "pool",
+		cfg:  map[string]string{"workload:pool": "cpu"},
+		want: []string{"cpu", "cpu", "cpu"},
+	}, {
+		name: "pools",
+		cfg:  map[string]string{"workload:pool": "cpu", "workload:pools": `["gpu", "cpu", "arm"]`},
+		want: []string{"gpu", "cpu", "arm"},
+	}, {
+		name: "some pools",
+		cfg:  map[string]string{"workload:pools": `["gpu"]`},
+		want: []string{"gpu", "default", "default"},
+	}, {
+		name: "too many pools",
+		cfg:  map[string]string{"workload:pools": `["a", "b", "c", "d"]`},
+		err:  "invalid workload:pools: 4 pools for 3 instances",
+	}, {
+		name: "empty pool",
+		cfg:  map[string]string{"workload:pools": `["a", ""]`},
+		err:  "invalid workload:pools: no pool for workload-1",
+	}, {
+		name: "not a list",
+		cfg:  map[string]string{"workload:pools": `{"gpu": 1}`},
+		err:  "invalid workload:pools",
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+
+			err := withConfig(t, tt.cfg, func(ctx *pulumi.Context) error {
+				var err error
+				got, err = WorkloadPools(ctx, 3)
+				return err
+			})
+
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got %q, %v, want error %q", got, err, tt.err)
+				}
+
+				return
+			}
+
+			if err != nil || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi/config"
+
+	"github.com/jpeach/pulumi-stacks/pkg/cloudinit"
+)
+
+// CloudInitPath is the default directory of user data fragments for
+// the workload instances.
+const CloudInitPath = "./cloud-init"
+
+// WorkloadUserData is the user data for the workload instances that
+// comes from the stack config and the fragment files.
+type WorkloadUserData struct {
+	Config    *cloudinit.Config
+	Fragments []cloudinit.Part
+}
+
+// NewWorkloadUserData reads the workload user data from the "cloudinit"
+// config namespace, and the fragments from the configured directory.
+func NewWorkloadUserData(ctx *pulumi.Context) (*WorkloadUserData, error) {
+	cloudOpts := config.New(ctx, "cloudinit")
+
+	w := &WorkloadUserData{Config: &cloudinit.Config{}}
+
+	for key, v := range map[string]interface{}{
+		"packages": &w.Config.Packages,
+		"users":    &w.Config.Users,
+		"files":    &w.Config.WriteFiles,
+		"runcmd":   &w.Config.RunCmd,
+	} {
+		if err := cloudOpts.GetObject(key, v); err != nil {
+			return nil, fmt.Errorf("invalid cloudinit:%s: %w", key, err)
+		}
+	}
+
+	// Listing users replaces the image's default user, which the SSH
+	// config logs in as, unless the default user is listed too.
+	if len(w.Config.Users) > 0 {
+		hasDefault := false
+		for _, u := range w.Config.Users {
+			hasDefault = hasDefault || u.Name == "default"
+		}
+
+		if !hasDefault {
+			w.Config.Users = append([]cloudinit.User{{Name: "default"}}, w.Config.Users...)
+		}
+	}
+
+	dir := cloudOpts.Get("fragments")
+	if dir == "" {
+		// The default directory is optional.
+		if _, err := os.Stat(CloudInitPath); os.IsNotExist(err) {
+			return w, nil
+		}
+
+		dir = CloudInitPath
+	}
+
+	fragments, err := cloudinit.LoadFragments(dir)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cloudinit:fragments: %w", err)
+	}
+
+	w.Fragments = fragments
+	return w, nil
+}
+
+// Encode merges the workload user data into the user data for an
+// instance, and returns the encoded document and its digest.
+func (w *WorkloadUserData) Encode(instanceData *cloudinit.Config) (string, string, error) {
+	c := instanceData.Copy()
+	c.Merge(w.Config)
+
+	doc, err := cloudinit.NewUserData(c, w.Fragments...)
+	if err != nil {
+		return "", "", err
+	}
+
+	return doc.Encode()
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+
+	"github.com/pulumi/pulumi-command/sdk/go/command/local"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi/config"
+	"inet.af/netaddr"
+
+	"github.com/jpeach/pulumi-stacks/pkg/cloudinit"
+	"github.com/jpeach/pulumi-stacks/pkg/wireguard"
+)
+
+// WireGuardConfigPath is the client configuration, for "wg-quick up" or
+// to import into a WireGuard app.
+const WireGuardConfigPath = "./ssh/wg0.conf"
+
+// The WireGuard private keys are kept with the SSH identity, so that
+// the bastion isn't replaced on each update.
+const (
+	WireGuardServerKeyPath = "./ssh/wireguard-server.key"
+	WireGuardClientKeyPath = "./ssh/wireguard-client.key"
+)
+
+// DefaultWireGuardTunnel is the default range of the tunnel addresses.
+var DefaultWireGuardTunnel = netaddr.MustParseIPPrefix("10.99.0.0/24")
+
+// WireGuard configures the bastion as a WireGuard endpoint, so that a
+// client can reach the VPC. The bastion masquerades the client traffic,
+// so the workload instances see it coming from the bastion.
+type WireGuard struct {
+	Port int
+	// Tunnel is the range of the tunnel addresses. The bastion has
+	// the first address, and the client the second.
+	Tunnel netaddr.IPPrefix
+	// Routes are the ranges that the client routes through the tunnel.
+	Routes []string
+	Server wireguard.Key
+	Client wireguard.Key
+}
+
+// NewWireGuard reads the WireGuard options from the "wireguard" config
+// namespace. It returns nil unless wireguard:enabled is true.
+func NewWireGuard(ctx *pulumi.Context, n *Network) (*WireGuard, error) {
+	wgOpts := config.New(ctx, "wireguard")
+
+	if !wgOpts.GetBool("enabled") {
+		return nil, nil
+	}
+
+	w := &WireGuard{
+		Port:   51820,
+		Tunnel: DefaultWireGuardTunnel,
+		Routes: []string{n.VPC.String()},
+	}
+
+	if v := wgOpts.GetInt("port"); v != 0 {
+		if v < 1 || v > 65535 {
+			return nil, fmt.Errorf("invalid wireguard:port %d", v)
+		}
+
+		w.Port = v
+	}
+
+	if v := wgOpts.Get("tunnel"); v != "" {
+		p, err := netaddr.ParseIPPrefix(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid wireguard:tunnel: %w", err)
+		}
+
+		w.Tunnel = p.Masked()
+	}
+
+	switch {
+	case !w.Tunnel.IP().Is4() || w.Tunnel.Bits() > 30:
+		return nil, fmt.Errorf("invalid wireguard:tunnel %s, must be an IPv4 range of at least /30", w.Tunnel)
+	case w.Tunnel.Overlaps(n.VPC):
+		return nil, fmt.Errorf("invalid wireguard:tunnel %s, overlaps the VPC %s", w.Tunnel, n.VPC)
+	}
+
+	var err error
+	if w.Server, err = wireguard.LoadKey(WireGuardServerKeyPath); err != nil {
+		return nil, err
+	}
+
+	if w.Client, err = wireguard.LoadKey(WireGuardClientKeyPath); err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// address returns the tunnel address of the nth host.
+func (w *WireGuard) address(n int) netaddr.IP {
+	ip := w.Tunnel.IP()
+	for i := 0; i < n; i++ {
+		ip = ip.Next()
+	}
+
+	return ip
+}
+
+// AddUserData adds the WireGuard server to the bastion user data.
+func (w *WireGuard) AddUserData(userData *cloudinit.Config) error {
+	clientKey, err := w.Client.PublicKey()
+	if err != nil {
+		return err
+	}
+
+	table := "ip wireguard"
+	server := wireguard.Config{
+		Interface: wireguard.Interface{
+			PrivateKey: w.Server,
+			Address:    netaddr.IPPrefixFrom(w.address(1), w.Tunnel.Bits()).String(),
+			ListenPort: w.Port,
+			PostUp: []string{
+				"nft add table " + table,
+				"nft add chain " + table + " postrouting '{ type nat hook postrouting priority srcnat; }'",
+				fmt.Sprintf("nft add rule %s postrouting ip saddr %s masquerade", table, w.Tunnel),
+			},
+			PostDown: []string{
+				"nft delete table " + table,
+			},
+		},
+		Peers: []wireguard.Peer{{
+			PublicKey:  clientKey,
+			AllowedIPs: []string{netaddr.IPPrefixFrom(w.address(2), 32).String()},
+		}},
+	}
+
+	userData.Packages = append(userData.Packages, "wireguard-tools", "nftables")
+	userData.AddFile(cloudinit.File{
+		Path:        "/etc/wireguard/wg0.conf",
+		Content:     server.Render(),
+		Permissions: "0600",
+	})
+	userData.AddFile(cloudinit.File{
+		Path:    "/etc/sysctl.d/90-wireguard.conf",
+		Content: "net.ipv4.ip_forward = 1\n",
+	})
+	userData.RunCmd = append(userData.RunCmd,
+		"sysctl --system",
+		"systemctl enable --now wg-quick@wg0",
+	)
+
+	return nil
+}
+
+// ClientConfig returns the client configuration for the bastion at
+// address.
+func (w *WireGuard) ClientConfig(address string) (string, error) {
+	serverKey, err := w.Server.PublicKey()
+	if err != nil {
+		return "", err
+	}
+
+	client := wireguard.Config{
+		Interface: wireguard.Interface{
+			PrivateKey: w.Client,
+			Address:    netaddr.IPPrefixFrom(w.address(2), 32).String(),
+		},
+		Peers: []wireguard.Peer{{
+			PublicKey:           serverKey,
+			AllowedIPs:          w.Routes,
+			Endpoint:            net.JoinHostPort(address, strconv.Itoa(w.Port)),
+			PersistentKeepalive: 25,
+		}},
+	}
+
+	return client.Render(), nil
+}
+
+// WriteClientConfig writes the client configuration once the bastion
+// address resolves, and registers a command resource that removes it
+// when the stack is destroyed.
+func (w *WireGuard) WriteClientConfig(ctx *pulumi.Context, address pulumi.StringOutput) error {
+	digest := address.ApplyT(func(addr string) (string, error) {
+		data, err := w.ClientConfig(addr)
+		if err != nil {
+			return "", err
+		}
+
+		if !ctx.DryRun() {
+			if err := ioutil.WriteFile(WireGuardConfigPath, []byte(data), 0600); err != nil {
+				return "", err
+			}
+		}
+
+		sum := sha256.Sum256([]byte(data))
+		return hex.EncodeToString(sum[:]), nil
+	}).(pulumi.StringOutput)
+
+	_, err := local.NewCommand(ctx, "wireguard/config", &local.CommandArgs{
+		Delete: pulumi.String("rm -f " + WireGuardConfigPath),
+		Environment: pulumi.StringMap{
+			"WIREGUARD_CONFIG_DIGEST": digest,
+		},
+	})
+
+	return err
+}
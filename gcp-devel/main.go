@@ -1,16 +1,10 @@
 package main
 
 import (
-	"bytes"
-	"crypto/rand"
-	"crypto/rsa"
-	"crypto/x509"
-	"encoding/base64"
-	"encoding/pem"
-	"errors"
 	"fmt"
 	"log"
 	"os/user"
+	"regexp"
 	"strings"
 
 	"github.com/pulumi/pulumi-gcp/sdk/v5/go/gcp/compute"
@@ -20,6 +14,10 @@ import (
 	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
 	"github.com/pulumi/pulumi/sdk/v3/go/pulumi/config"
 	"golang.org/x/crypto/ssh"
+	"inet.af/netaddr"
+
+	"github.com/jpeach/pulumi-stacks/pkg/ingress"
+	"github.com/jpeach/pulumi-stacks/pkg/keys"
 )
 
 // DefaultNamePrefix is the default prefix for resource names.
@@ -49,34 +47,72 @@ type Config struct {
 	Location string
 }
 
-// GenerateSSHKeys ...
-// TODO: collapse this in to the keygen code from aws-devel
-func GenerateSSHKeys() (string, string, error) {
-	// IMPORTANT: For GCP it has to be 3072 bit key, when tried to use 2048 or
-	//            4096 it was not adding it to the authorized_keys file on
-	//            cluster nodes, even if the key was present in a gcp console
-	//            (in node's metadata)
-	priv, err := rsa.GenerateKey(rand.Reader, 3072)
+// GenerateSSHKeys generates a new SSH key that GCP will accept,
+// returning the PEM-encoded private key and the public key in
+// authorized_keys format, with the given comment.
+func GenerateSSHKeys(comment string) (string, string, error) {
+	priv, err := keys.Generate(keys.RSA3072)
 	if err != nil {
 		return "", "", err
 	}
 
-	b := pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: x509.MarshalPKCS1PrivateKey(priv),
-	}
-
-	privBuffer := bytes.NewBuffer([]byte{})
-	if err := pem.Encode(privBuffer, &b); err != nil {
+	privPEM, err := keys.MarshalPrivateKey(priv, nil)
+	if err != nil {
 		return "", "", err
 	}
 
-	public, err := ssh.NewPublicKey(&priv.PublicKey)
+	pub, err := keys.PublicKeyOf(priv)
 	if err != nil {
 		return "", "", err
 	}
 
-	return privBuffer.String(), base64.StdEncoding.EncodeToString(public.Marshal()), nil
+	return string(privPEM), keys.MarshalAuthorizedKeyWithComment(pub, comment), nil
+}
+
+// SSHKeys holds the SSH keys for the cluster nodes.
+type SSHKeys struct {
+	// PrivateKey is the PEM-encoded private key.
+	PrivateKey string
+	// PublicKey is the public key in authorized_keys format.
+	PublicKey string
+	// Previous is the public key that is being retired. It is empty
+	// unless this update is the overlap window of a key rotation.
+	Previous string
+}
+
+// AuthorizedKeys returns the public keys that should be authorized on
+// the cluster nodes.
+func (k *SSHKeys) AuthorizedKeys() ([]ssh.PublicKey, error) {
+	var authorized []ssh.PublicKey
+
+	for _, s := range []string{k.PublicKey, k.Previous} {
+		if s == "" {
+			continue
+		}
+
+		key, _, err := keys.ParsePublicKey(s)
+		if err != nil {
+			return nil, fmt.Errorf("secret %q: %w", PublicKeySecretName, err)
+		}
+
+		if err := keys.GCP.Check(key); err != nil {
+			return nil, fmt.Errorf("secret %q: %w", PublicKeySecretName, err)
+		}
+
+		authorized = append(authorized, key)
+	}
+
+	return authorized, nil
+}
+
+// rotationComment is the public key comment that records the token of
+// the rotation that generated the key.
+func rotationComment(token string) string {
+	if token == "" {
+		return ""
+	}
+
+	return "rotation:" + token
 }
 
 var (
@@ -84,6 +120,162 @@ var (
 	PublicKeySecretName  = "kuma-main-ssh-public-key"
 )
 
+// googleAPINotFound is how the provider's Google API client formats a
+// 404 response (see googleapi.Error), e.g. "googleapi: Error 404: Secret
+// [projects/p/secrets/s] not found or has no versions.".
+var googleAPINotFound = regexp.MustCompile(`\bgoogleapi: Error 404: `)
+
+// secretNotFound returns whether the error from a Secret Manager lookup
+// means that the secret (or any version of it) doesn't exist, rather
+// than a permission or network failure.
+//
+// The lookup runs in the provider plugin, so the error only reaches us
+// as text, and the typed googleapi.Error is lost. Match the whole 404
+// prefix, rather than just a status or reason that could appear in
+// any message.
+func secretNotFound(err error) bool {
+	return googleAPINotFound.MatchString(err.Error())
+}
+
+// lookupSecret returns the latest version of the named secret. If the
+// secret doesn't exist, it returns nil.
+func lookupSecret(ctx *pulumi.Context, name string) (*secretmanager.LookupSecretVersionResult, error) {
+	v, err := secretmanager.LookupSecretVersion(ctx, &secretmanager.LookupSecretVersionArgs{
+		Secret: name,
+	})
+	switch {
+	case err == nil:
+		return v, nil
+	case secretNotFound(err):
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("failed to look up secret %q: %w", name, err)
+	}
+}
+
+// createSecretVersion adds a version holding data to the secret. The
+// version is retained when it is removed from the stack, since it will
+// be looked up rather than created on subsequent updates.
+func createSecretVersion(ctx *pulumi.Context, name string, secret pulumi.StringInput, data string, opts ...pulumi.ResourceOption) error {
+	opts = append(opts, pulumi.RetainOnDelete(true))
+
+	_, err := secretmanager.NewSecretVersion(ctx, name, &secretmanager.SecretVersionArgs{
+		Secret:     secret,
+		SecretData: pulumi.ToSecret(pulumi.String(data)).(pulumi.StringOutput),
+	}, opts...)
+
+	return err
+}
+
+// createSecret creates a new secret named name holding data. Like its
+// version, the secret is retained when it is removed from the stack.
+func createSecret(ctx *pulumi.Context, name string, data string) error {
+	secret, err := secretmanager.NewSecret(ctx, name, &secretmanager.SecretArgs{
+		SecretId: pulumi.String(name),
+		Replication: secretmanager.SecretReplicationArgs{
+			Automatic: pulumi.Bool(true),
+		},
+	}, pulumi.RetainOnDelete(true))
+	if err != nil {
+		return err
+	}
+
+	return createSecretVersion(ctx, name, secret.Name, data, pulumi.Parent(secret))
+}
+
+// LookupSSHKeys returns the SSH keys stored in GCP Secret Manager.
+//
+// If neither secret exists and bootstrap is true, it generates a new
+// key and creates the secrets.
+//
+// If rotation is not empty and differs from the token of the last
+// rotation, it generates a new key and adds it as a new version of the
+// secrets. Both the new and the previous keys should be authorized
+// for this update. On the next update, only the new key is returned.
+func LookupSSHKeys(ctx *pulumi.Context, bootstrap bool, rotation string) (*SSHKeys, error) {
+	privateSecret, err := lookupSecret(ctx, PrivateKeySecretName)
+	if err != nil {
+		return nil, err
+	}
+
+	publicSecret, err := lookupSecret(ctx, PublicKeySecretName)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case privateSecret != nil && publicSecret != nil:
+		// Both keys exist, so check whether to rotate them.
+	case privateSecret != nil || publicSecret != nil:
+		return nil, fmt.Errorf("only one of secrets %q and %q exists",
+			PrivateKeySecretName, PublicKeySecretName)
+	case !bootstrap:
+		return nil, fmt.Errorf(
+			"no SSH keys in GCP Secret Manager, set gcp-devel:bootstrapSSHKeys to create secrets %q and %q",
+			PrivateKeySecretName, PublicKeySecretName)
+	default:
+		privateKey, publicKey, err := GenerateSSHKeys(rotationComment(rotation))
+		if err != nil {
+			return nil, err
+		}
+
+		if err := createSecret(ctx, PrivateKeySecretName, privateKey); err != nil {
+			return nil, err
+		}
+
+		if err := createSecret(ctx, PublicKeySecretName, publicKey); err != nil {
+			return nil, err
+		}
+
+		_ = ctx.Log.Info(fmt.Sprintf("Creating SSH keys in GCP Secret Manager secrets %q and %q",
+			PrivateKeySecretName, PublicKeySecretName), nil)
+
+		return &SSHKeys{PrivateKey: privateKey, PublicKey: publicKey}, nil
+	}
+
+	current := &SSHKeys{
+		PrivateKey: privateSecret.SecretData,
+		PublicKey:  publicSecret.SecretData,
+	}
+
+	_, comment, err := keys.ParsePublicKey(current.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("secret %q: %w", PublicKeySecretName, err)
+	}
+
+	if rotation == "" || comment == rotationComment(rotation) {
+		return current, nil
+	}
+
+	privateKey, publicKey, err := GenerateSSHKeys(rotationComment(rotation))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, v := range []struct {
+		secret *secretmanager.LookupSecretVersionResult
+		name   string
+		data   string
+	}{
+		{privateSecret, PrivateKeySecretName, privateKey},
+		{publicSecret, PublicKeySecretName, publicKey},
+	} {
+		secret := fmt.Sprintf("projects/%s/secrets/%s", v.secret.Project, v.name)
+		if err := createSecretVersion(ctx, v.name+"/rotation", pulumi.String(secret), v.data); err != nil {
+			return nil, err
+		}
+	}
+
+	_ = ctx.Log.Info(fmt.Sprintf("Rotating SSH keys in GCP Secret Manager secrets %q and %q",
+		PrivateKeySecretName, PublicKeySecretName), nil)
+
+	return &SSHKeys{
+		PrivateKey: privateKey,
+		PublicKey:  publicKey,
+		Previous:   current.PublicKey,
+	}, nil
+}
+
 func genName(value ...string) string {
 	if DefaultNamePrefix == "" {
 		return strings.Join(value, "-")
@@ -92,6 +284,44 @@ func genName(value ...string) string {
 	return strings.Join(append([]string{DefaultNamePrefix}, value...), "-")
 }
 
+// NewSSHFirewalls creates the firewall rules that allow inbound SSH
+// from the sources. A rule can't mix IPv4 and IPv6 ranges, so there is a
+// rule for each address family. A rule with no source ranges would
+// allow any source, so there is no rule for a family without sources.
+func NewSSHFirewalls(ctx *pulumi.Context, network *compute.Network, sources *ingress.Sources) error {
+	rules := []struct {
+		name    string
+		sources []netaddr.IPPrefix
+	}{
+		{genName("allow-ssh"), sources.IPv4},
+		{genName("allow-ssh-v6"), sources.IPv6},
+	}
+
+	for _, r := range rules {
+		if len(r.sources) == 0 {
+			continue
+		}
+
+		_, err := compute.NewFirewall(ctx, r.name, &compute.FirewallArgs{
+			Network: network.Name,
+			Allows: compute.FirewallAllowArray{
+				&compute.FirewallAllowArgs{
+					Protocol: pulumi.String("tcp"),
+					Ports: pulumi.StringArray{
+						pulumi.String("22"),
+					},
+				},
+			},
+			SourceRanges: pulumi.ToStringArray(ingress.Strings(r.sources)),
+		}, pulumi.Parent(network))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func main() {
 	u, err := user.Current()
 	if err != nil {
@@ -112,45 +342,19 @@ func main() {
 			Location: conf.Require("location"),
 		}
 
-		var privateKey string
-		var publicKey string
-
-		privateKeySecret, err := secretmanager.LookupSecretVersion(ctx, &secretmanager.LookupSecretVersionArgs{
-			Secret: PrivateKeySecretName,
-		})
+		sshKeys, err := LookupSSHKeys(ctx, conf.GetBool("bootstrapSSHKeys"), conf.Get("sshKeyRotation"))
 		if err != nil {
-			if privateKey, publicKey, err = GenerateSSHKeys(); err != nil {
-				return err
-			}
-
-			_ = ctx.Log.Info("No ssh keys in GCP Secret Manager", nil)
-			_ = ctx.Log.Info("To create them:", nil)
-			_ = ctx.Log.Info("###", nil)
-
-			privateKey = strings.ReplaceAll(privateKey, "\n", "\\n")
-
-			createPrivKey := fmt.Sprintf("printf -- '%s' | gcloud secrets create %s --data-file=-", privateKey, PrivateKeySecretName)
-			createPubKey := fmt.Sprintf("printf -- '%s' | gcloud secrets create %s --data-file=-", publicKey, PublicKeySecretName)
-
-			_ = ctx.Log.Info(createPrivKey, nil)
-			_ = ctx.Log.Info("###", nil)
-			_ = ctx.Log.Info(createPubKey, nil)
-
-			return errors.New("cannot proceed without necessary ssh keys")
+			return err
 		}
 
-		publicKeySecret, err := secretmanager.LookupSecretVersion(ctx, &secretmanager.LookupSecretVersionArgs{
-			Secret: PublicKeySecretName,
-		})
+		authorizedKeys, err := sshKeys.AuthorizedKeys()
 		if err != nil {
 			return err
 		}
 
-		privateKey = privateKeySecret.SecretData
-		publicKey = publicKeySecret.SecretData
-
-		sshKeys := []string{
-			fmt.Sprintf("%s:ssh-rsa %s %[1]s", u.Username, publicKey),
+		var sshKeysMetadata []string
+		for _, k := range authorizedKeys {
+			sshKeysMetadata = append(sshKeysMetadata, keys.MetadataSSHKey(u.Username, k))
 		}
 
 		svcAcc, err := serviceaccount.NewAccount(ctx, genName(), &serviceaccount.AccountArgs{
@@ -177,26 +381,27 @@ func main() {
 			return err
 		}
 
-		_, err = compute.NewFirewall(ctx, genName("allow-ssh"), &compute.FirewallArgs{
-			Network: network.Name,
-			Allows: compute.FirewallAllowArray{
-				&compute.FirewallAllowArgs{
-					Protocol: pulumi.String("tcp"),
-					Ports: pulumi.StringArray{
-						pulumi.String("22"),
-					},
-				},
-			},
-			SourceRanges: pulumi.StringArray{
-				pulumi.String("0.0.0.0/0"),
-			},
-		}, pulumi.Parent(network))
+		var sshAllowFrom []string
+		if err := conf.GetObject("sshAllowFrom", &sshAllowFrom); err != nil {
+			return fmt.Errorf("invalid sshAllowFrom: %w", err)
+		}
+
+		resolver := ingress.DefaultResolver
+		if url := conf.Get("sshAllowFromResolver"); url != "" {
+			resolver = &ingress.HTTPResolver{URL: url}
+		}
+
+		sshSources, err := ingress.Parse(ctx.Context(), sshAllowFrom, resolver)
 		if err != nil {
+			return fmt.Errorf("invalid sshAllowFrom: %w", err)
+		}
+
+		if err := NewSSHFirewalls(ctx, network, sshSources); err != nil {
 			return err
 		}
 
 		for _, name := range clustersCfg.Names {
-			cluster, err := CreateCluster(ctx, &cfg, genName(name), network, sshKeys, svcAcc, subnetwork)
+			cluster, err := CreateCluster(ctx, &cfg, genName(name), network, sshKeysMetadata, svcAcc, subnetwork)
 			if err != nil {
 				return err
 			}
@@ -227,8 +432,8 @@ func main() {
 		}
 
 		ctx.Export("service-account", svcAcc.AccountId)
-		ctx.Export("private-key", pulumi.ToSecret(privateKey))
-		ctx.Export("public-key", pulumi.ToSecret(publicKey))
+		ctx.Export("private-key", pulumi.ToSecret(sshKeys.PrivateKey))
+		ctx.Export("public-key", pulumi.ToSecret(sshKeys.PublicKey))
 
 		return nil
 	})
@@ -0,0 +1,184 @@
+package cloudinit
+
+import (
+	"encoding/json"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Header is the first line of a cloud-config document.
+const Header = "#cloud-config\n"
+
+// Config is a cloud-init cloud-config document. Only the modules that
+// the stacks use are modeled.
+//
+// See https://cloudinit.readthedocs.io/en/latest/reference/modules.html
+//
+// The types have JSON tags as well as YAML tags, since the stack config
+// is decoded as JSON.
+type Config struct {
+	Packages   []string `yaml:"packages,omitempty" json:"packages,omitempty"`
+	Users      []User   `yaml:"users,omitempty" json:"users,omitempty"`
+	WriteFiles []File   `yaml:"write_files,omitempty" json:"write_files,omitempty"`
+	RunCmd     []string `yaml:"runcmd,omitempty" json:"runcmd,omitempty"`
+
+	// SSHKeys holds the SSH host keys, see AddSSHHostKey.
+	SSHKeys map[string]string `yaml:"ssh_keys,omitempty" json:"ssh_keys,omitempty"`
+}
+
+// File is a file for the write_files module.
+type File struct {
+	Path        string `yaml:"path" json:"path"`
+	Content     string `yaml:"content" json:"content"`
+	Owner       string `yaml:"owner,omitempty" json:"owner,omitempty"`
+	Permissions string `yaml:"permissions,omitempty" json:"permissions,omitempty"`
+}
+
+// User is a user for the users module. The user named "default" is the
+// image's pre-configured user, which is only created if it is listed.
+type User struct {
+	Name              string     `yaml:"name" json:"name"`
+	Groups            StringList `yaml:"groups,omitempty" json:"groups,omitempty"`
+	Sudo              StringList `yaml:"sudo,omitempty" json:"sudo,omitempty"`
+	Shell             string     `yaml:"shell,omitempty" json:"shell,omitempty"`
+	SSHAuthorizedKeys []string   `yaml:"ssh_authorized_keys,omitempty" json:"ssh_authorized_keys,omitempty"`
+}
+
+// MarshalYAML renders the default user as a plain "default" entry.
+func (u User) MarshalYAML() (interface{}, error) {
+	if u.Name == "default" && len(u.Groups) == 0 && len(u.Sudo) == 0 && u.Shell == "" && len(u.SSHAuthorizedKeys) == 0 {
+		return "default", nil
+	}
+
+	type user User
+	return user(u), nil
+}
+
+// UnmarshalYAML accepts a plain user name, like the "default" entry.
+func (u *User) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		*u = User{Name: node.Value}
+		return nil
+	}
+
+	type user User
+	return node.Decode((*user)(u))
+}
+
+// StringList is a list of strings that can also be written as a single
+// string, as cloud-init accepts for the user "groups" and "sudo" keys.
+// A single string renders as a string, so it reaches cloud-init as it
+// was written.
+type StringList []string
+
+// MarshalYAML renders a single string as a string.
+func (l StringList) MarshalYAML() (interface{}, error) {
+	if len(l) == 1 {
+		return l[0], nil
+	}
+
+	return []string(l), nil
+}
+
+// UnmarshalYAML accepts a string or a list of strings.
+func (l *StringList) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		*l = StringList{node.Value}
+		return nil
+	}
+
+	return node.Decode((*[]string)(l))
+}
+
+// UnmarshalJSON accepts a string or a list of strings.
+func (l *StringList) UnmarshalJSON(b []byte) error {
+	if string(b) == "null" {
+		return nil
+	}
+
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*l = StringList{s}
+		return nil
+	}
+
+	return json.Unmarshal(b, (*[]string)(l))
+}
+
+// AddFile adds a file to the document.
+func (c *Config) AddFile(f File) {
+	c.WriteFiles = append(c.WriteFiles, f)
+}
+
+// AddSSHHostKey installs a host key of the given type (e.g. "ed25519")
+// in place of the key that sshd would generate on first boot.
+func (c *Config) AddSSHHostKey(keyType string, private string, public string) {
+	if c.SSHKeys == nil {
+		c.SSHKeys = map[string]string{}
+	}
+
+	c.SSHKeys[keyType+"_private"] = private
+	c.SSHKeys[keyType+"_public"] = public
+}
+
+// Copy returns a copy of the document, so that it can be customized
+// for each host.
+func (c *Config) Copy() *Config {
+	n := &Config{
+		Packages:   append([]string(nil), c.Packages...),
+		Users:      append([]User(nil), c.Users...),
+		WriteFiles: append([]File(nil), c.WriteFiles...),
+		RunCmd:     append([]string(nil), c.RunCmd...),
+	}
+
+	if c.SSHKeys != nil {
+		n.SSHKeys = map[string]string{}
+		for k, v := range c.SSHKeys {
+			n.SSHKeys[k] = v
+		}
+	}
+
+	return n
+}
+
+// Merge appends the modules in o to the document. Where both set the
+// same SSH host key, the key in o wins.
+func (c *Config) Merge(o *Config) {
+	c.Packages = append(c.Packages, o.Packages...)
+	c.Users = append(c.Users, o.Users...)
+	c.WriteFiles = append(c.WriteFiles, o.WriteFiles...)
+	c.RunCmd = append(c.RunCmd, o.RunCmd...)
+
+	for k, v := range o.SSHKeys {
+		if c.SSHKeys == nil {
+			c.SSHKeys = map[string]string{}
+		}
+
+		c.SSHKeys[k] = v
+	}
+}
+
+// Render renders the cloud-config document. An empty document renders
+// to the empty string, so that hosts without any configuration don't
+// get any user data.
+func (c *Config) Render() (string, error) {
+	var b strings.Builder
+
+	enc := yaml.NewEncoder(&b)
+	enc.SetIndent(2)
+
+	if err := enc.Encode(c); err != nil {
+		return "", err
+	}
+
+	if err := enc.Close(); err != nil {
+		return "", err
+	}
+
+	if b.String() == "{}\n" {
+		return "", nil
+	}
+
+	return Header + b.String(), nil
+}
@@ -0,0 +1,160 @@
+package cloudinit
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestRender(t *testing.T) {
+	c := &Config{
+		Packages: []string{"git"},
+		Users: []User{
+			{Name: "default"},
+			{Name: "dev", Groups: StringList{"wheel, adm"}, Sudo: StringList{"ALL=(ALL) NOPASSWD:ALL"}, SSHAuthorizedKeys: []string{"ssh-ed25519 AAAA dev"}},
+			{Name: "ops", Groups: StringList{"wheel", "adm"}},
+		},
+		WriteFiles: []File{{Path: "/etc/motd", Content: "hello\n", Permissions: "0644"}},
+		RunCmd:     []string{"systemctl enable --now podman.socket"},
+	}
+	c.AddSSHHostKey("ed25519", "private", "public")
+
+	want := `#cloud-config
+packages:
+  - git
+users:
+  - default
+  - name: dev
+    groups: wheel, adm
+    sudo: ALL=(ALL) NOPASSWD:ALL
+    ssh_authorized_keys:
+      - ssh-ed25519 AAAA dev
+  - name: ops
+    groups:
+      - wheel
+      - adm
+write_files:
+  - path: /etc/motd
+    content: |
+      hello
+    permissions: "0644"
+runcmd:
+  - systemctl enable --now podman.socket
+ssh_keys:
+  ed25519_private: private
+  ed25519_public: public
+`
+
+	got, err := c.Render()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got != want {
+		t.Fatalf("got\n%s\nwant\n%s", got, want)
+	}
+
+	// The rendered document decodes back to the same config.
+	var back Config
+	if err := yaml.Unmarshal([]byte(got), &back); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(&back, c) {
+		t.Errorf("round trip got %+v, want %+v", back, *c)
+	}
+}
+
+func TestRenderEmpty(t *testing.T) {
+	if got, err := (&Config{}).Render(); got != "" || err != nil {
+		t.Errorf("got %q, %v, want nothing", got, err)
+	}
+}
+
+func TestDecodeJSON(t *testing.T) {
+	// This is how the stack config decodes cloudinit:users.
+	const users = `[
+		{"name": "dev", "groups": "wheel", "sudo": ["ALL=(ALL) ALL"], "ssh_authorized_keys": ["ssh-ed25519 AAAA dev"]},
+		{"name": "ops", "groups": ["wheel", "adm"], "sudo": null}
+	]`
+
+	var got []User
+	if err := json.Unmarshal([]byte(users), &got); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []User{
+		{Name: "dev", Groups: StringList{"wheel"}, Sudo: StringList{"ALL=(ALL) ALL"}, SSHAuthorizedKeys: []string{"ssh-ed25519 AAAA dev"}},
+		{Name: "ops", Groups: StringList{"wheel", "adm"}},
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	var files []File
+	if err := json.Unmarshal([]byte(`[{"path": "/etc/motd", "content": "hi", "permissions": "0600"}]`), &files); err != nil {
+		t.Fatal(err)
+	}
+
+	if f := (File{Path: "/etc/motd", Content: "hi", Permissions: "0600"}); len(files) != 1 || files[0] != f {
+		t.Errorf("got files %+v", files)
+	}
+
+	var bad []User
+	if err := json.Unmarshal([]byte(`[{"name": "dev", "groups": 7}]`), &bad); err == nil {
+		t.Errorf("decoded a numeric group, want an error")
+	}
+}
+
+func TestMerge(t *testing.T) {
+	c := &Config{
+		Packages: []string{"git"},
+		RunCmd:   []string{"one"},
+	}
+	c.AddSSHHostKey("ed25519", "host private", "host public")
+
+	o := &Config{
+		Packages:   []string{"make"},
+		Users:      []User{{Name: "dev"}},
+		WriteFiles: []File{{Path: "/etc/motd", Content: "hi"}},
+		RunCmd:     []string{"two"},
+	}
+	o.AddSSHHostKey("ed25519", "other private", "other public")
+	o.AddSSHHostKey("rsa", "rsa private", "rsa public")
+
+	orig := c.Copy()
+	c.Merge(o)
+
+	want := &Config{
+		Packages:   []string{"git", "make"},
+		Users:      []User{{Name: "dev"}},
+		WriteFiles: []File{{Path: "/etc/motd", Content: "hi"}},
+		RunCmd:     []string{"one", "two"},
+		SSHKeys: map[string]string{
+			"ed25519_private": "other private",
+			"ed25519_public":  "other public",
+			"rsa_private":     "rsa private",
+			"rsa_public":      "rsa public",
+		},
+	}
+
+	if !reflect.DeepEqual(c, want) {
+		t.Errorf("got %+v, want %+v", *c, *want)
+	}
+
+	// Merging into a copy leaves the original alone.
+	if orig.SSHKeys["ed25519_private"] != "host private" || len(orig.Packages) != 1 {
+		t.Errorf("merging changed the copy: %+v", *orig)
+	}
+
+	// Merging into an empty document adds the host keys.
+	e := &Config{}
+	e.Merge(o)
+	if !strings.HasPrefix(e.SSHKeys["rsa_private"], "rsa") {
+		t.Errorf("got host keys %v", e.SSHKeys)
+	}
+}
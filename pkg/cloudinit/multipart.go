@@ -0,0 +1,218 @@
+package cloudinit
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"mime/multipart"
+	"net/textproto"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// MaxUserDataSize is the largest user data that EC2 accepts, after
+// compression but before base64 encoding.
+const MaxUserDataSize = 16 * 1024
+
+// MergeType tells cloud-init to append lists when it merges cloud-config
+// parts, rather than the later part replacing them.
+//
+// See https://cloudinit.readthedocs.io/en/latest/reference/merging.html
+const MergeType = "list(append)+dict(no_replace,recurse_list)+str()"
+
+// contentTypes maps the first line of a part to its content type.
+var contentTypes = []struct {
+	prefix      string
+	contentType string
+}{
+	{"#cloud-config", "text/cloud-config"},
+	{"#cloud-boothook", "text/cloud-boothook"},
+	{"#include", "text/x-include-url"},
+	{"#!", "text/x-shellscript"},
+}
+
+// Part is a part of a multipart user data document.
+type Part struct {
+	Filename    string
+	ContentType string
+	Content     string
+}
+
+// NewPart returns a part with the content type given by the first line
+// of the content, as cloud-init would detect it.
+func NewPart(filename string, content string) (*Part, error) {
+	for _, t := range contentTypes {
+		if strings.HasPrefix(content, t.prefix) {
+			return &Part{Filename: filename, ContentType: t.contentType, Content: content}, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%s: unknown user data type", filename)
+}
+
+// LoadFragments loads the user data parts from the files in dir, in
+// name order. Cloud-config fragments are checked to be valid YAML.
+func LoadFragments(dir string) ([]Part, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+
+	var parts []Part
+	for _, e := range entries {
+		if e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+
+		b, err := ioutil.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		p, err := NewPart(e.Name(), string(b))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", dir, err)
+		}
+
+		if p.ContentType == "text/cloud-config" {
+			var v interface{}
+			if err := yaml.Unmarshal(b, &v); err != nil {
+				return nil, fmt.Errorf("%s: %w", filepath.Join(dir, e.Name()), err)
+			}
+		}
+
+		parts = append(parts, *p)
+	}
+
+	return parts, nil
+}
+
+// UserData is a multipart user data document.
+type UserData struct {
+	Parts []Part
+}
+
+// NewUserData returns a document made of the rendered cloud-config
+// document, if it isn't empty, followed by the fragments.
+func NewUserData(c *Config, fragments ...Part) (*UserData, error) {
+	u := &UserData{}
+
+	data, err := c.Render()
+	if err != nil {
+		return nil, err
+	}
+
+	if data != "" {
+		u.Parts = append(u.Parts, Part{
+			Filename:    "stack.yaml",
+			ContentType: "text/cloud-config",
+			Content:     data,
+		})
+	}
+
+	u.Parts = append(u.Parts, fragments...)
+	return u, nil
+}
+
+// boundary returns a MIME boundary that depends only on the parts, so
+// that the same parts always render the same way.
+func (u *UserData) boundary() string {
+	h := sha256.New()
+	for _, p := range u.Parts {
+		fmt.Fprintf(h, "%s\x00%s\x00%s\x00", p.Filename, p.ContentType, p.Content)
+	}
+
+	return "==" + hex.EncodeToString(h.Sum(nil))[:32] + "=="
+}
+
+// Render renders the MIME multipart document. An empty document renders
+// to the empty string.
+func (u *UserData) Render() (string, error) {
+	if len(u.Parts) == 0 {
+		return "", nil
+	}
+
+	var body bytes.Buffer
+
+	w := multipart.NewWriter(&body)
+	if err := w.SetBoundary(u.boundary()); err != nil {
+		return "", err
+	}
+
+	for _, p := range u.Parts {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Type", fmt.Sprintf("%s; charset=\"utf-8\"", p.ContentType))
+		header.Set("MIME-Version", "1.0")
+		header.Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", p.Filename))
+
+		if p.ContentType == "text/cloud-config" {
+			header.Set("Merge-Type", MergeType)
+		}
+
+		part, err := w.CreatePart(header)
+		if err != nil {
+			return "", err
+		}
+
+		if _, err := part.Write([]byte(p.Content)); err != nil {
+			return "", err
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "Content-Type: multipart/mixed; boundary=\"%s\"\r\n", w.Boundary())
+	fmt.Fprintf(&b, "MIME-Version: 1.0\r\n\r\n")
+	b.Write(body.Bytes())
+
+	return b.String(), nil
+}
+
+// Encode renders the document and compresses it with gzip, which
+// cloud-init detects. It returns the base64 encoding of the compressed
+// document, and the SHA-256 digest of the rendered document. An empty
+// document encodes to empty strings.
+func (u *UserData) Encode() (string, string, error) {
+	data, err := u.Render()
+	if err != nil || data == "" {
+		return "", "", err
+	}
+
+	var gz bytes.Buffer
+
+	w, err := gzip.NewWriterLevel(&gz, gzip.BestCompression)
+	if err != nil {
+		return "", "", err
+	}
+
+	if _, err := w.Write([]byte(data)); err != nil {
+		return "", "", err
+	}
+
+	if err := w.Close(); err != nil {
+		return "", "", err
+	}
+
+	if gz.Len() > MaxUserDataSize {
+		return "", "", fmt.Errorf("user data is %d bytes compressed, more than the limit of %d bytes",
+			gz.Len(), MaxUserDataSize)
+	}
+
+	digest := sha256.Sum256([]byte(data))
+	return base64.StdEncoding.EncodeToString(gz.Bytes()), hex.EncodeToString(digest[:]), nil
+}
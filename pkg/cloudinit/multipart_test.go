@@ -0,0 +1,228 @@
+package cloudinit
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNewPart(t *testing.T) {
+	tests := []struct {
+		content     string
+		contentType string
+	}{
+		{"#cloud-config\npackages: [git]\n", "text/cloud-config"},
+		{"#!/bin/sh\ntrue\n", "text/x-shellscript"},
+		{"#cloud-boothook\n", "text/cloud-boothook"},
+		{"#include\nhttps://example.com\n", "text/x-include-url"},
+		{"packages: [git]\n", ""},
+	}
+
+	for _, tt := range tests {
+		p, err := NewPart("part", tt.content)
+		if tt.contentType == "" {
+			if err == nil {
+				t.Errorf("%q: got %s, want an error", tt.content, p.ContentType)
+			}
+
+			continue
+		}
+
+		if err != nil || p.ContentType != tt.contentType {
+			t.Errorf("%q: got %v, %v, want %s", tt.content, p, err, tt.contentType)
+		}
+	}
+}
+
+func TestLoadFragments(t *testing.T) {
+	dir := t.TempDir()
+
+	for name, content := range map[string]string{
+		"20-script.sh":  "#!/bin/sh\ntrue\n",
+		"10-base.yaml":  "#cloud-config\npackages: [git]\n",
+		".hidden":       "not user data",
+		"30-extra.yaml": "#cloud-config\nruncmd: [date]\n",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	parts, err := LoadFragments(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, p := range parts {
+		names = append(names, p.Filename)
+	}
+
+	if got := strings.Join(names, " "); got != "10-base.yaml 20-script.sh 30-extra.yaml" {
+		t.Errorf("got fragments %s", got)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "40-bad.yaml"), []byte("#cloud-config\n: [\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := LoadFragments(dir); err == nil || !strings.Contains(err.Error(), "40-bad.yaml") {
+		t.Errorf("got %v, want an error for the invalid fragment", err)
+	}
+
+	if _, err := LoadFragments(filepath.Join(dir, "missing")); !os.IsNotExist(err) {
+		t.Errorf("got %v, want a missing directory", err)
+	}
+}
+
+func TestUserDataRender(t *testing.T) {
+	script, err := NewPart("20-script.sh", "#!/bin/sh\ntrue\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := NewUserData(&Config{Packages: []string{"git"}}, *script)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := u.Render()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The same parts render the same way.
+	if again, _ := u.Render(); again != data {
+		t.Errorf("rendering isn't stable")
+	}
+
+	header, body, ok := strings.Cut(data, "\r\n\r\n")
+	if !ok {
+		t.Fatalf("no header in\n%s", data)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(strings.TrimPrefix(strings.Split(header, "\r\n")[0], "Content-Type: "))
+	if err != nil || mediaType != "multipart/mixed" {
+		t.Fatalf("got content type %q, %v", mediaType, err)
+	}
+
+	want := []struct {
+		filename    string
+		contentType string
+		mergeType   string
+		content     string
+	}{
+		{"stack.yaml", "text/cloud-config", MergeType, "#cloud-config\npackages:\n  - git\n"},
+		{"20-script.sh", "text/x-shellscript", "", "#!/bin/sh\ntrue\n"},
+	}
+
+	r := multipart.NewReader(strings.NewReader(body), params["boundary"])
+	for _, w := range want {
+		p, err := r.NextPart()
+		if err != nil {
+			t.Fatalf("%s: %s", w.filename, err)
+		}
+
+		content, _ := ioutil.ReadAll(p)
+
+		if p.FileName() != w.filename {
+			t.Errorf("got part %q, want %q", p.FileName(), w.filename)
+		}
+
+		if got := p.Header.Get("Content-Type"); got != w.contentType+`; charset="utf-8"` {
+			t.Errorf("%s: got content type %q", w.filename, got)
+		}
+
+		if got := p.Header.Get("Merge-Type"); got != w.mergeType {
+			t.Errorf("%s: got merge type %q, want %q", w.filename, got, w.mergeType)
+		}
+
+		if string(content) != w.content {
+			t.Errorf("%s: got content %q, want %q", w.filename, content, w.content)
+		}
+	}
+
+	if _, err := r.NextPart(); err != io.EOF {
+		t.Errorf("got %v after the last part, want EOF", err)
+	}
+
+	// A change to any part changes the boundary.
+	script.Content += "date\n"
+	other, _ := NewUserData(&Config{Packages: []string{"git"}}, *script)
+	if other.boundary() == u.boundary() {
+		t.Errorf("changing a part kept the boundary")
+	}
+}
+
+func TestUserDataEncode(t *testing.T) {
+	u, err := NewUserData(&Config{Packages: []string{"git"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := u.Render()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encoded, digest, err := u.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	compressed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plain, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(plain) != data {
+		t.Errorf("got\n%s\nwant\n%s", plain, data)
+	}
+
+	sum := sha256.Sum256([]byte(data))
+	if digest != hex.EncodeToString(sum[:]) {
+		t.Errorf("got digest %s, want the digest of the rendered document", digest)
+	}
+
+	empty, _ := NewUserData(&Config{})
+	if encoded, digest, err := empty.Encode(); encoded != "" || digest != "" || err != nil {
+		t.Errorf("empty document got %q, %q, %v", encoded, digest, err)
+	}
+
+	// Random data doesn't compress, so this is over the limit.
+	noise := make([]byte, MaxUserDataSize)
+	if _, err := rand.Read(noise); err != nil {
+		t.Fatal(err)
+	}
+
+	big := &UserData{Parts: []Part{{
+		Filename:    "noise.sh",
+		ContentType: "text/x-shellscript",
+		Content:     "#!/bin/sh\n# " + base64.StdEncoding.EncodeToString(noise),
+	}}}
+
+	if _, _, err := big.Encode(); err == nil || !strings.Contains(err.Error(), "more than the limit") {
+		t.Errorf("got %v, want a size error", err)
+	}
+}
@@ -0,0 +1,310 @@
+package conf
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Keyword is a SSH client configuration keyword.
+//
+// See ssh_config(5).
+type Keyword string
+
+// Keywords that the stacks use. Keywords are matched case-insensitively,
+// so other keywords can be used by converting them.
+const (
+	Hostname              Keyword = "Hostname"
+	User                  Keyword = "User"
+	Port                  Keyword = "Port"
+	IdentityFile          Keyword = "IdentityFile"
+	IdentitiesOnly        Keyword = "IdentitiesOnly"
+	IdentityAgent         Keyword = "IdentityAgent"
+	CertificateFile       Keyword = "CertificateFile"
+	ControlMaster         Keyword = "ControlMaster"
+	ControlPersist        Keyword = "ControlPersist"
+	ControlPath           Keyword = "ControlPath"
+	LocalForward          Keyword = "LocalForward"
+	RemoteForward         Keyword = "RemoteForward"
+	DynamicForward        Keyword = "DynamicForward"
+	ServerAliveInterval   Keyword = "ServerAliveInterval"
+	ProxyCommand          Keyword = "ProxyCommand"
+	ProxyJump             Keyword = "ProxyJump"
+	StrictHostKeyChecking Keyword = "StrictHostKeyChecking"
+	UserKnownHostsFile    Keyword = "UserKnownHostsFile"
+)
+
+// Directive is a keyword and its arguments.
+type Directive struct {
+	Keyword Keyword
+	Value   string
+}
+
+func (d Directive) is(k Keyword) bool {
+	return strings.EqualFold(string(d.Keyword), string(k))
+}
+
+// Host is a Host block, holding the directives that apply to the hosts
+// matching its patterns.
+type Host struct {
+	Patterns   []string
+	Directives []Directive
+}
+
+// NewHost returns a new Host block for the given patterns.
+func NewHost(patterns ...string) *Host {
+	return &Host{Patterns: patterns}
+}
+
+// Name returns the first pattern of the host.
+func (h *Host) Name() string {
+	if len(h.Patterns) == 0 {
+		return ""
+	}
+
+	return h.Patterns[0]
+}
+
+// Add appends a directive. Use this for keywords that can be given
+// more than once, such as IdentityFile.
+func (h *Host) Add(k Keyword, value string) {
+	h.Directives = append(h.Directives, Directive{Keyword: k, Value: value})
+}
+
+// Set replaces all the directives for the keyword with a single
+// directive, keeping the position of the first one.
+func (h *Host) Set(k Keyword, value string) {
+	var directives []Directive
+	set := false
+
+	for _, d := range h.Directives {
+		if !d.is(k) {
+			directives = append(directives, d)
+		} else if !set {
+			directives = append(directives, Directive{Keyword: k, Value: value})
+			set = true
+		}
+	}
+
+	if !set {
+		directives = append(directives, Directive{Keyword: k, Value: value})
+	}
+
+	h.Directives = directives
+}
+
+// Get returns the value of the first directive for the keyword.
+func (h *Host) Get(k Keyword) (string, bool) {
+	for _, d := range h.Directives {
+		if d.is(k) {
+			return d.Value, true
+		}
+	}
+
+	return "", false
+}
+
+// GetAll returns the values of all the directives for the keyword.
+func (h *Host) GetAll(k Keyword) []string {
+	var values []string
+	for _, d := range h.Directives {
+		if d.is(k) {
+			values = append(values, d.Value)
+		}
+	}
+
+	return values
+}
+
+// Equal returns whether the hosts have the same patterns and directives.
+func (h *Host) Equal(o *Host) bool {
+	return h.String() == o.String()
+}
+
+// String renders the host block.
+func (h *Host) String() string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "Host %s\n", strings.Join(h.Patterns, " "))
+	for _, d := range h.Directives {
+		fmt.Fprintf(&b, "  %s %s\n", d.Keyword, d.Value)
+	}
+
+	return b.String()
+}
+
+// Config is a SSH client configuration file, made of the global
+// directives followed by the Host blocks in order.
+type Config struct {
+	Global Host
+	Hosts  []*Host
+}
+
+// Host returns the Host block named name, or nil.
+func (c *Config) Host(name string) *Host {
+	for _, h := range c.Hosts {
+		if h.Name() == name {
+			return h
+		}
+	}
+
+	return nil
+}
+
+// SetHost replaces the Host block that has the same name as h, or
+// appends h if there is none.
+func (c *Config) SetHost(h *Host) {
+	for i := range c.Hosts {
+		if c.Hosts[i].Name() == h.Name() {
+			c.Hosts[i] = h
+			return
+		}
+	}
+
+	c.Hosts = append(c.Hosts, h)
+}
+
+// RemoveHost removes the Host block named name.
+func (c *Config) RemoveHost(name string) {
+	var hosts []*Host
+	for _, h := range c.Hosts {
+		if h.Name() != name {
+			hosts = append(hosts, h)
+		}
+	}
+
+	c.Hosts = hosts
+}
+
+// String renders the configuration file.
+func (c *Config) String() string {
+	var b strings.Builder
+
+	for _, d := range c.Global.Directives {
+		fmt.Fprintf(&b, "%s %s\n", d.Keyword, d.Value)
+	}
+
+	for _, h := range c.Hosts {
+		if b.Len() > 0 {
+			b.WriteString("\n")
+		}
+		b.WriteString(h.String())
+	}
+
+	return b.String()
+}
+
+// Diff describes the changes from c to o, one line per changed block.
+func (c *Config) Diff(o *Config) []string {
+	var changes []string
+
+	if !c.Global.Equal(&o.Global) {
+		changes = append(changes, "~ global options")
+	}
+
+	for _, h := range c.Hosts {
+		switch n := o.Host(h.Name()); {
+		case n == nil:
+			changes = append(changes, "- Host "+h.Name())
+		case !h.Equal(n):
+			changes = append(changes, "~ Host "+h.Name())
+		}
+	}
+
+	for _, h := range o.Hosts {
+		if c.Host(h.Name()) == nil {
+			changes = append(changes, "+ Host "+h.Name())
+		}
+	}
+
+	return changes
+}
+
+// WriteFile atomically replaces the file named by path with the
+// rendered configuration.
+func (c *Config) WriteFile(path string, perm os.FileMode) error {
+	return WriteFileAtomic(path, []byte(c.String()), perm)
+}
+
+// Parse parses a SSH client configuration. Comments and blank lines
+// are discarded. Match blocks are not supported.
+func Parse(r io.Reader) (*Config, error) {
+	c := &Config{}
+	current := &c.Global
+
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		// The keyword and arguments may be separated by whitespace
+		// or by an optional "=".
+		keyword, value := line, ""
+		if i := strings.IndexAny(line, " \t="); i >= 0 {
+			keyword = line[:i]
+			value = strings.TrimSpace(line[i:])
+			value = strings.TrimSpace(strings.TrimPrefix(value, "="))
+		}
+
+		switch {
+		case strings.EqualFold(keyword, "Host"):
+			current = NewHost(strings.Fields(value)...)
+			c.Hosts = append(c.Hosts, current)
+		case strings.EqualFold(keyword, "Match"):
+			return nil, fmt.Errorf("line %d: Match blocks are not supported", n)
+		default:
+			current.Add(Keyword(keyword), value)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// ParseFile parses the SSH client configuration file named by path.
+func ParseFile(path string) (*Config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return Parse(bytes.NewReader(b))
+}
+
+// WriteFileAtomic writes data to a temporary file in the same directory
+// as path, then renames it over path, so that readers see either the
+// old or the new contents.
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	fh, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(fh.Name())
+
+	if _, err := fh.Write(data); err != nil {
+		fh.Close()
+		return err
+	}
+
+	if err := fh.Chmod(perm); err != nil {
+		fh.Close()
+		return err
+	}
+
+	if err := fh.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(fh.Name(), path)
+}
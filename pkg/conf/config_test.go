@@ -0,0 +1,228 @@
+package conf
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const sampleConfig = `# Global options.
+Include ~/.ssh/config.d/*
+StrictHostKeyChecking accept-new
+
+Host bastion 203.0.113.1
+  Hostname 203.0.113.1
+  User fedora
+  IdentityFile "/home/me/my keys/identity.pem"
+  ControlPath=~/.ssh/%C
+
+host workload-0
+	Hostname 172.16.2.4
+	ProxyJump bastion
+	LocalForward 8080 localhost:80
+	LocalForward 8443 localhost:443
+
+Host *
+  ServerAliveInterval 30
+`
+
+func TestParse(t *testing.T) {
+	c, err := Parse(strings.NewReader(sampleConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	global := []Directive{
+		{Keyword: "Include", Value: "~/.ssh/config.d/*"},
+		{Keyword: "StrictHostKeyChecking", Value: "accept-new"},
+	}
+
+	if !reflect.DeepEqual(c.Global.Directives, global) {
+		t.Errorf("got global %v, want %v", c.Global.Directives, global)
+	}
+
+	var names []string
+	for _, h := range c.Hosts {
+		names = append(names, h.Name())
+	}
+
+	if want := []string{"bastion", "workload-0", "*"}; !reflect.DeepEqual(names, want) {
+		t.Fatalf("got hosts %v, want %v", names, want)
+	}
+
+	bastion := c.Host("bastion")
+	if want := []string{"bastion", "203.0.113.1"}; !reflect.DeepEqual(bastion.Patterns, want) {
+		t.Errorf("got patterns %v, want %v", bastion.Patterns, want)
+	}
+
+	// Quoted values are kept as they are, quotes included.
+	if v, _ := bastion.Get(IdentityFile); v != `"/home/me/my keys/identity.pem"` {
+		t.Errorf("got IdentityFile %s", v)
+	}
+
+	// Keywords match case-insensitively, and may be followed by "=".
+	if v, ok := bastion.Get(ControlPath); !ok || v != "~/.ssh/%C" {
+		t.Errorf("got ControlPath %q, %t", v, ok)
+	}
+
+	workload := c.Host("workload-0")
+	if got := workload.GetAll(LocalForward); !reflect.DeepEqual(got, []string{"8080 localhost:80", "8443 localhost:443"}) {
+		t.Errorf("got LocalForward %v", got)
+	}
+
+	if v, _ := c.Host("*").Get(ServerAliveInterval); v != "30" {
+		t.Errorf("got ServerAliveInterval %q for Host *", v)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	c, err := Parse(strings.NewReader(sampleConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `Include ~/.ssh/config.d/*
+StrictHostKeyChecking accept-new
+
+Host bastion 203.0.113.1
+  Hostname 203.0.113.1
+  User fedora
+  IdentityFile "/home/me/my keys/identity.pem"
+  ControlPath ~/.ssh/%C
+
+Host workload-0
+  Hostname 172.16.2.4
+  ProxyJump bastion
+  LocalForward 8080 localhost:80
+  LocalForward 8443 localhost:443
+
+Host *
+  ServerAliveInterval 30
+`
+
+	if got := c.String(); got != want {
+		t.Fatalf("got\n%s\nwant\n%s", got, want)
+	}
+
+	// Rendering is stable once the comments and formatting are gone.
+	again, err := Parse(strings.NewReader(c.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := again.String(); got != want {
+		t.Errorf("second round trip got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestParseMatch(t *testing.T) {
+	_, err := Parse(strings.NewReader("Host a\n  User me\nMatch host b\n  User you\n"))
+	if err == nil || !strings.Contains(err.Error(), "line 3: Match blocks are not supported") {
+		t.Errorf("got error %v, want a Match error", err)
+	}
+}
+
+func TestSetHost(t *testing.T) {
+	c := &Config{}
+
+	h := NewHost("bastion")
+	h.Add(Hostname, "203.0.113.1")
+	h.Add(IdentityFile, "a")
+	h.Add(IdentityFile, "b")
+	c.SetHost(h)
+
+	h.Set(IdentityFile, "c")
+	if got := h.GetAll(IdentityFile); !reflect.DeepEqual(got, []string{"c"}) {
+		t.Errorf("got IdentityFile %v after Set", got)
+	}
+
+	n := NewHost("bastion")
+	n.Add(Hostname, "203.0.113.2")
+	c.SetHost(n)
+
+	if len(c.Hosts) != 1 || c.Host("bastion") != n {
+		t.Errorf("SetHost didn't replace the host: %v", c.Hosts)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	c, err := Parse(strings.NewReader(sampleConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Formatting doesn't count as a change.
+	same, err := Parse(strings.NewReader(c.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if changes := c.Diff(same); len(changes) != 0 {
+		t.Errorf("got changes %v for the same config", changes)
+	}
+
+	o, err := Parse(strings.NewReader(sampleConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	o.Global.Set(StrictHostKeyChecking, "yes")
+	o.Host("bastion").Set(User, "ec2-user")
+	o.RemoveHost("workload-0")
+
+	h := NewHost("workload-1")
+	h.Add(Hostname, "172.16.2.5")
+	o.SetHost(h)
+
+	want := []string{
+		"~ global options",
+		"~ Host bastion",
+		"- Host workload-0",
+		"+ Host workload-1",
+	}
+
+	if got := c.Diff(o); !reflect.DeepEqual(got, want) {
+		t.Errorf("got changes %v, want %v", got, want)
+	}
+
+	if got := (&Config{}).Diff(c); !reflect.DeepEqual(got, []string{"~ global options", "+ Host bastion", "+ Host workload-0", "+ Host *"}) {
+		t.Errorf("got changes %v from an empty config", got)
+	}
+}
+
+func TestSSHDiff(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config")
+
+	written, err := NewSSH(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := written.WriteHost(Entry{Name: "workload-0", Address: "172.16.2.4"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A preview builds the config without writing it.
+	preview, err := NewSSH(path, Options{DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := preview.WriteHost(Entry{Name: "workload-1", Address: "172.16.2.5"}); err != nil {
+		t.Fatal(err)
+	}
+
+	changes, err := preview.Diff()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{"- Host workload-0", "+ Host workload-1"}; !reflect.DeepEqual(changes, want) {
+		t.Errorf("got changes %v, want %v", changes, want)
+	}
+
+	if changes, err := written.Diff(); len(changes) != 0 || err != nil {
+		t.Errorf("got changes %v, %v for the written config", changes, err)
+	}
+}
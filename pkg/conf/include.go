@@ -0,0 +1,161 @@
+package conf
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// UserConfigPath returns the path of the user's SSH client
+// configuration file, ~/.ssh/config.
+func UserConfigPath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(home, ".ssh", "config"), nil
+}
+
+// includeFence returns the comment lines that begin and end the
+// Include block for the named stack.
+func includeFence(name string) (string, string) {
+	return "# BEGIN pulumi-stacks " + name, "# END pulumi-stacks " + name
+}
+
+// removeBlock removes the lines from begin to end, inclusive, along
+// with the blank line that separates the block from the next line. A
+// begin line without a matching end line is left alone, along with the
+// lines after it, since the file has been edited by hand.
+func removeBlock(lines []string, begin string, end string) []string {
+	var kept []string
+	var held []string
+	skip := false
+	blank := false
+
+	for _, l := range lines {
+		switch {
+		case l == begin && !skip:
+			skip, held = true, []string{l}
+		case l == end && skip:
+			skip, held, blank = false, nil, true
+		case skip:
+			held = append(held, l)
+		case blank && l == "":
+			blank = false
+		default:
+			blank = false
+			kept = append(kept, l)
+		}
+	}
+
+	return append(kept, held...)
+}
+
+// readLines reads the file named by path, following symlinks so that
+// a config file that is managed elsewhere is updated in place. It
+// returns the resolved path, the file mode and the lines in the file.
+func readLines(path string) (string, os.FileMode, []string, error) {
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return path, 0600, nil, nil
+	}
+	if err != nil {
+		return "", 0, nil, err
+	}
+
+	st, err := os.Stat(path)
+	if err != nil {
+		return "", 0, nil, err
+	}
+
+	text := strings.TrimSuffix(string(b), "\n")
+	if text == "" {
+		return path, st.Mode().Perm(), nil, nil
+	}
+
+	return path, st.Mode().Perm(), strings.Split(text, "\n"), nil
+}
+
+// writeLines atomically replaces the file named by path with lines.
+func writeLines(path string, perm os.FileMode, lines []string) error {
+	var data string
+	if len(lines) > 0 {
+		data = strings.Join(lines, "\n") + "\n"
+	}
+
+	return WriteFileAtomic(path, []byte(data), perm)
+}
+
+// InstallInclude adds a block that includes the SSH client configuration
+// file include to the configuration file at path (usually ~/.ssh/config).
+// The block is fenced by comments naming the stack, so that it can be
+// replaced or removed later without touching the rest of the file. It
+// goes at the top of the file, since an Include after a Host line only
+// applies to that host.
+func InstallInclude(path string, name string, include string) error {
+	include, err := filepath.Abs(include)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	path, perm, lines, err := readLines(path)
+	if err != nil {
+		return err
+	}
+
+	begin, end := includeFence(name)
+	block := []string{
+		begin,
+		fmt.Sprintf("Include %s", include),
+		end,
+	}
+
+	lines = removeBlock(lines, begin, end)
+	if len(lines) > 0 && lines[0] != "" {
+		block = append(block, "")
+	}
+
+	return writeLines(path, perm, append(block, lines...))
+}
+
+// RemoveIncludeCommand returns a shell command that removes the Include
+// block for the named stack from the SSH client configuration file at
+// path. Pulumi doesn't run the program when a stack is
+// destroyed, so this is the command to run from a resource's delete
+// hook.
+func RemoveIncludeCommand(path string, name string) string {
+	begin, end := includeFence(name)
+
+	return strings.Join([]string{
+		fmt.Sprintf("f=%s", ShellQuote(path)),
+		`test -f "$f" || exit 0`,
+		`tmp=$(mktemp) || exit 1`,
+		fmt.Sprintf(`awk -v b=%s -v e=%s '`+
+			`$0 == b && !skip { skip = 1; n = 0; held[++n] = $0; next } `+
+			`$0 == e && skip { skip = 0; blank = 1; next } `+
+			`skip { held[++n] = $0; next } `+
+			`blank && $0 == "" { blank = 0; next } `+
+			`{ blank = 0; print } `+
+			`END { if (skip) for (i = 1; i <= n; i++) print held[i] }' "$f" > "$tmp" && cat "$tmp" > "$f"`,
+			ShellQuote(begin), ShellQuote(end)),
+		`rc=$?`,
+		`rm -f "$tmp"`,
+		`exit $rc`,
+	}, "\n")
+}
+
+// ShellQuote quotes s for the POSIX shell.
+func ShellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,132 @@
+package conf
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+const userConfig = `Host github.com
+  User git
+`
+
+// readFile returns the contents of the file at path.
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(b)
+}
+
+// removeInclude runs RemoveIncludeCommand for the file at path.
+func removeInclude(t *testing.T, path string, name string) {
+	t.Helper()
+
+	if out, err := exec.Command("sh", "-c", RemoveIncludeCommand(path, name)).CombinedOutput(); err != nil {
+		t.Fatalf("%s: %s", err, out)
+	}
+}
+
+func TestInstallInclude(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, ".ssh", "config")
+	include := filepath.Join(dir, "stack", "config")
+
+	// The directory and file don't exist yet.
+	if err := InstallInclude(path, "aws-devel-dev", include); err != nil {
+		t.Fatal(err)
+	}
+
+	block := "# BEGIN pulumi-stacks aws-devel-dev\n" +
+		"Include " + include + "\n" +
+		"# END pulumi-stacks aws-devel-dev\n"
+
+	if got := readFile(t, path); got != block {
+		t.Fatalf("got\n%s\nwant\n%s", got, block)
+	}
+
+	if err := ioutil.WriteFile(path, []byte(userConfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Installing again replaces the block, and leaves the rest of the
+	// file alone.
+	want := block + "\n" + userConfig
+	for i := 0; i < 2; i++ {
+		if err := InstallInclude(path, "aws-devel-dev", include); err != nil {
+			t.Fatal(err)
+		}
+
+		if got := readFile(t, path); got != want {
+			t.Fatalf("install %d got\n%s\nwant\n%s", i, got, want)
+		}
+	}
+
+	if st, err := os.Stat(path); err != nil || st.Mode().Perm() != 0600 {
+		t.Errorf("got mode %v, %v, want 0600", st.Mode(), err)
+	}
+
+	// Another stack gets its own block.
+	if err := InstallInclude(path, "gcp-devel-dev", include); err != nil {
+		t.Fatal(err)
+	}
+
+	removeInclude(t, path, "gcp-devel-dev")
+	if got := readFile(t, path); got != want {
+		t.Fatalf("got\n%s\nwant\n%s", got, want)
+	}
+
+	removeInclude(t, path, "aws-devel-dev")
+	if got := readFile(t, path); got != userConfig {
+		t.Fatalf("got\n%s\nwant\n%s", got, userConfig)
+	}
+
+	// Removing is idempotent, and a missing file is fine.
+	removeInclude(t, path, "aws-devel-dev")
+	if got := readFile(t, path); got != userConfig {
+		t.Fatalf("got\n%s\nwant\n%s", got, userConfig)
+	}
+
+	removeInclude(t, filepath.Join(dir, "missing"), "aws-devel-dev")
+}
+
+func TestIncludeMissingEnd(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config")
+	include := "/stack/config"
+
+	// The END fence was removed by hand, so the lines after the BEGIN
+	// fence belong to the user.
+	edited := "# BEGIN pulumi-stacks aws-devel-dev\n" +
+		"Include /stack/config\n" +
+		"\n" +
+		userConfig
+
+	if err := ioutil.WriteFile(path, []byte(edited), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	removeInclude(t, path, "aws-devel-dev")
+	if got := readFile(t, path); got != edited {
+		t.Fatalf("removing got\n%s\nwant\n%s", got, edited)
+	}
+
+	if err := InstallInclude(path, "aws-devel-dev", include); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "# BEGIN pulumi-stacks aws-devel-dev\n" +
+		"Include /stack/config\n" +
+		"# END pulumi-stacks aws-devel-dev\n" +
+		"\n" +
+		edited
+
+	if got := readFile(t, path); got != want {
+		t.Fatalf("installing got\n%s\nwant\n%s", got, want)
+	}
+}
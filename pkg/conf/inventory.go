@@ -0,0 +1,190 @@
+package conf
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// InventoryHost is a host in an Ansible inventory.
+type InventoryHost struct {
+	// Name is the inventory hostname.
+	Name string
+	// Groups are the groups that the host belongs to.
+	Groups []string
+	// Vars are the host variables, e.g. "ansible_host".
+	Vars map[string]string
+}
+
+// Inventory is an Ansible inventory.
+//
+// See https://docs.ansible.com/ansible/latest/inventory_guide/intro_inventory.html
+type Inventory struct {
+	Hosts []*InventoryHost
+}
+
+// Host returns the host named name, or nil.
+func (inv *Inventory) Host(name string) *InventoryHost {
+	for _, h := range inv.Hosts {
+		if h.Name == name {
+			return h
+		}
+	}
+
+	return nil
+}
+
+// SetHost replaces the host that has the same name as h, or appends h
+// if there is none.
+func (inv *Inventory) SetHost(h *InventoryHost) {
+	for i := range inv.Hosts {
+		if inv.Hosts[i].Name == h.Name {
+			inv.Hosts[i] = h
+			return
+		}
+	}
+
+	inv.Hosts = append(inv.Hosts, h)
+}
+
+// sorted returns the hosts in name order. The hosts are set as the
+// resources they describe are created, so the order they were set in
+// varies between runs.
+func (inv *Inventory) sorted() []*InventoryHost {
+	hosts := append([]*InventoryHost(nil), inv.Hosts...)
+
+	sort.SliceStable(hosts, func(i, j int) bool {
+		return naturalLess(hosts[i].Name, hosts[j].Name)
+	})
+
+	return hosts
+}
+
+// groups returns the members of each group, in host name order.
+func (inv *Inventory) groups() (map[string][]string, []string) {
+	members := map[string][]string{}
+	var names []string
+
+	for _, h := range inv.sorted() {
+		for _, g := range h.Groups {
+			if _, ok := members[g]; !ok {
+				names = append(names, g)
+			}
+
+			members[g] = append(members[g], h.Name)
+		}
+	}
+
+	sort.Strings(names)
+	return members, names
+}
+
+// sortedKeys returns the keys of m in order.
+func sortedKeys(m map[string]string) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+	return keys
+}
+
+// safeWord matches strings that don't need to be quoted.
+var safeWord = regexp.MustCompile(`^[A-Za-z0-9_@%+=:,./-]+$`)
+
+// quoteWord quotes s if it isn't a single shell word. Ansible splits
+// INI host lines and SSH arguments like the shell does.
+func quoteWord(s string) string {
+	if safeWord.MatchString(s) {
+		return s
+	}
+
+	return ShellQuote(s)
+}
+
+// INI renders the inventory in the INI format. The host variables are
+// given on the host lines at the top, and the groups list the hosts.
+// The hosts are in name order, so the same hosts always render the same.
+func (inv *Inventory) INI() string {
+	var b strings.Builder
+
+	for _, h := range inv.sorted() {
+		b.WriteString(h.Name)
+		for _, k := range sortedKeys(h.Vars) {
+			fmt.Fprintf(&b, " %s=%s", k, quoteWord(h.Vars[k]))
+		}
+		b.WriteString("\n")
+	}
+
+	members, names := inv.groups()
+	for _, g := range names {
+		fmt.Fprintf(&b, "\n[%s]\n", g)
+		for _, h := range members[g] {
+			b.WriteString(h + "\n")
+		}
+	}
+
+	return b.String()
+}
+
+// inventoryGroup is a group in the YAML inventory format.
+type inventoryGroup struct {
+	Hosts    map[string]map[string]string `yaml:"hosts,omitempty"`
+	Children map[string]*inventoryGroup   `yaml:"children,omitempty"`
+}
+
+// YAML renders the inventory in the YAML format. The host variables are
+// given under the "all" group, and the child groups list the hosts.
+func (inv *Inventory) YAML() (string, error) {
+	all := &inventoryGroup{
+		Hosts:    map[string]map[string]string{},
+		Children: map[string]*inventoryGroup{},
+	}
+
+	for _, h := range inv.Hosts {
+		all.Hosts[h.Name] = h.Vars
+	}
+
+	members, names := inv.groups()
+	for _, g := range names {
+		group := &inventoryGroup{Hosts: map[string]map[string]string{}}
+		for _, h := range members[g] {
+			group.Hosts[h] = nil
+		}
+
+		all.Children[g] = group
+	}
+
+	var b strings.Builder
+
+	enc := yaml.NewEncoder(&b)
+	enc.SetIndent(2)
+
+	if err := enc.Encode(map[string]*inventoryGroup{"all": all}); err != nil {
+		return "", err
+	}
+
+	if err := enc.Close(); err != nil {
+		return "", err
+	}
+
+	return b.String(), nil
+}
+
+// Render renders the inventory in the format given by the extension of
+// path, which is ".ini", ".yaml" or ".yml".
+func (inv *Inventory) Render(path string) (string, error) {
+	switch filepath.Ext(path) {
+	case ".ini":
+		return inv.INI(), nil
+	case ".yaml", ".yml":
+		return inv.YAML()
+	default:
+		return "", fmt.Errorf("unsupported inventory format %q", path)
+	}
+}
@@ -0,0 +1,37 @@
+package conf
+
+import (
+	"testing"
+)
+
+func TestInventoryOrder(t *testing.T) {
+	hosts := []*InventoryHost{
+		{Name: "workload-10", Groups: []string{"workload"}, Vars: map[string]string{"ansible_host": "172.16.2.14"}},
+		{Name: "bastion", Groups: []string{"bastion"}, Vars: map[string]string{"ansible_host": "203.0.113.1"}},
+		{Name: "workload-2", Groups: []string{"workload"}, Vars: map[string]string{"ansible_host": "172.16.2.6"}},
+	}
+
+	want := `bastion ansible_host=203.0.113.1
+workload-2 ansible_host=172.16.2.6
+workload-10 ansible_host=172.16.2.14
+
+[bastion]
+bastion
+
+[workload]
+workload-2
+workload-10
+`
+
+	// The output doesn't depend on the order that the hosts are set.
+	for _, order := range [][]int{{0, 1, 2}, {2, 1, 0}, {1, 0, 2}} {
+		inv := &Inventory{}
+		for _, i := range order {
+			inv.SetHost(hosts[i])
+		}
+
+		if got := inv.INI(); got != want {
+			t.Errorf("order %v: got\n%s\nwant\n%s", order, got, want)
+		}
+	}
+}
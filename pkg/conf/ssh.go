@@ -1,21 +1,59 @@
 package conf
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
 )
 
-// SSH helps generate a SSH client configuration file.
+// Options configures a SSH client configuration file.
+type Options struct {
+	// PinHostKeys is true if the known_hosts file will contain the
+	// keys for all the hosts, so SSH should reject unknown host keys
+	// instead of trusting them on first use.
+	PinHostKeys bool
+	// DryRun is true if the configuration should be built, but not
+	// written.
+	DryRun bool
+	// Namespace is prefixed to the host aliases, so that the
+	// configurations for several stacks can be included in the user's
+	// SSH configuration without colliding. When it is set, the default
+	// options only apply to the namespaced hosts.
+	Namespace string
+	// Inventory is the path to write an Ansible inventory of the stack
+	// hosts to. The format follows the extension, ".ini" or ".yaml".
+	Inventory string
+}
+
+// SSH helps generate a SSH client configuration file. Each change
+// rewrites the whole file, so that the file on disk is always complete.
 type SSH struct {
-	configPath  string
-	controlPath string
-	lock        sync.Mutex
+	opts           Options
+	configPath     string
+	controlPath    string
+	knownHostsPath string
+	identityAgent  string
+	certificate    string
+	inventoryPath  string
+	config         *Config
+	inventory      *Inventory
+	knownHosts     map[string]string
+	lock           sync.Mutex
 }
 
 // NewSSH creates a new SSH client configuration file at path.
-func NewSSH(path string) (*SSH, error) {
+func NewSSH(path string, opts Options) (*SSH, error) {
 	configPath, err := filepath.Abs(path)
 	if err != nil {
 		return nil, err
@@ -26,86 +64,469 @@ func NewSSH(path string) (*SSH, error) {
 		return nil, err
 	}
 
-	fh, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0640)
-	if err != nil {
+	s := SSH{
+		opts:           opts,
+		configPath:     configPath,
+		controlPath:    controlPath,
+		knownHostsPath: filepath.Join(filepath.Dir(configPath), "known_hosts"),
+		config:         &Config{},
+		inventory:      &Inventory{},
+		knownHosts:     map[string]string{},
+	}
+
+	if opts.Inventory != "" {
+		if s.inventoryPath, err = filepath.Abs(opts.Inventory); err != nil {
+			return nil, err
+		}
+
+		if _, err := s.inventory.Render(s.inventoryPath); err != nil {
+			return nil, err
+		}
+	}
+
+	strict := "accept-new"
+	if opts.PinHostKeys {
+		strict = "yes"
+	}
+
+	s.config.Global.Add(StrictHostKeyChecking, strict)
+	s.config.Global.Add(UserKnownHostsFile, s.knownHostsPath)
+
+	if err := s.flush(); err != nil {
 		return nil, err
 	}
 
-	_ = fh.Close()
+	return &s, nil
+}
+
+// Path returns the absolute path of the configuration file.
+func (s *SSH) Path() string {
+	return s.configPath
+}
 
-	s := SSH{
-		configPath:  configPath,
-		controlPath: controlPath,
+// Alias returns the host alias for name, prefixed by the namespace.
+func (s *SSH) Alias(name string) string {
+	if s.opts.Namespace == "" {
+		return name
 	}
 
-	s.append(func(fh *os.File) error {
-		fh.WriteString("User fedora\n") // XXX(jpeach)
-		fh.WriteString("StrictHostKeyChecking accept-new\n")
-		fh.WriteString(fmt.Sprintf("UserKnownHostsFile %s\n",
-			filepath.Join(filepath.Dir(configPath), "known_hosts")))
+	return s.opts.Namespace + "-" + name
+}
 
-		return nil
+// Config returns a copy of the configuration that has been built so far.
+func (s *SSH) Config() *Config {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.render()
+}
+
+// render returns the configuration file contents. Host blocks are
+// sorted by name so that the output doesn't depend on the order that
+// hosts were added. The global options go in a final Host block that
+// matches all the (namespaced) hosts, since SSH uses the first value
+// it finds for each option, and host entries may override them.
+func (s *SSH) render() *Config {
+	c := &Config{}
+	for _, h := range s.config.Hosts {
+		n := *h
+		c.Hosts = append(c.Hosts, &n)
+	}
+
+	sort.SliceStable(c.Hosts, func(i, j int) bool {
+		return naturalLess(c.Hosts[i].Name(), c.Hosts[j].Name())
 	})
 
-	return &s, nil
+	defaults := s.config.Global
+	defaults.Patterns = []string{s.Alias("*")}
+	c.Hosts = append(c.Hosts, &defaults)
+
+	return c
 }
 
-func (s *SSH) append(writer func(*os.File) error) error {
+// Diff describes how the configuration that has been built so far
+// differs from the file on disk.
+func (s *SSH) Diff() ([]string, error) {
+	current, err := ParseFile(s.configPath)
+	if os.IsNotExist(err) {
+		current = &Config{}
+	} else if err != nil {
+		return nil, err
+	}
+
+	return current.Diff(s.Config()), nil
+}
+
+// knownHostsLines returns the known_hosts file contents.
+func (s *SSH) knownHostsLines() string {
+	var addresses []string
+	for a := range s.knownHosts {
+		addresses = append(addresses, a)
+	}
+
+	sort.Slice(addresses, func(i, j int) bool {
+		return naturalLess(addresses[i], addresses[j])
+	})
+
+	var lines strings.Builder
+	for _, a := range addresses {
+		lines.WriteString(s.knownHosts[a] + "\n")
+	}
+
+	return lines.String()
+}
+
+// Digest returns a hash of the files that have been built so far, so
+// that a resource can track changes to them.
+func (s *SSH) Digest() string {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
-	fh, err := os.OpenFile(s.configPath, os.O_WRONLY|os.O_APPEND, 0)
-	if err != nil {
-		return err
+	h := sha256.New()
+	io.WriteString(h, s.render().String())
+	io.WriteString(h, s.knownHostsLines())
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// RemoveCommand returns a shell command that removes the configuration
+// file, the known_hosts file, the inventory and the control sockets,
+// stopping any master connections first. Pulumi doesn't run the
+// program when a stack is destroyed, so this is the command to run
+// from a resource's delete hook.
+func (s *SSH) RemoveCommand() string {
+	cmd := []string{
+		fmt.Sprintf("d=%s", ShellQuote(s.controlPath)),
+		`for c in "$d"/*; do test -S "$c" && ssh -S "$c" -O exit _ 2>/dev/null; done`,
+		fmt.Sprintf(`rm -rf "$d" %s %s`, ShellQuote(s.configPath), ShellQuote(s.knownHostsPath)),
 	}
 
-	defer fh.Close()
+	if s.inventoryPath != "" {
+		cmd = append(cmd, fmt.Sprintf("rm -f %s", ShellQuote(s.inventoryPath)))
+	}
 
-	return writer(fh)
+	return strings.Join(cmd, "\n")
 }
 
-// WriteBastionHost writes a host entry named "bastion". This is a SSH
-// proxy host that workload host sessions will proxy through.
-func (s *SSH) WriteBastionHost(address string, identity string) error {
-	identity, err := filepath.Abs(identity)
-	if err != nil {
+// flush writes the configuration file, the inventory, and the
+// known_hosts file if the host keys are pinned.
+func (s *SSH) flush() error {
+	if s.opts.DryRun {
+		return nil
+	}
+
+	if err := s.render().WriteFile(s.configPath, 0640); err != nil {
 		return err
 	}
 
-	return s.append(func(fh *os.File) error {
-		_, err = fh.WriteString(
-			fmt.Sprintf(`
-Host bastion
-  Hostname %s
-  IdentityFile %s
-  ControlMaster auto
-  ControlPersist 5m
-  ControlPath %s/%%r@%%h:%%p
-`,
-				address, identity, s.controlPath,
-			))
+	if s.inventoryPath != "" {
+		// The format was checked by NewSSH.
+		data, _ := s.inventory.Render(s.inventoryPath)
+		if err := WriteFileAtomic(s.inventoryPath, []byte(data), 0640); err != nil {
+			return err
+		}
+	}
 
-		return err
-	})
+	// If the keys aren't pinned, SSH adds them to known_hosts itself.
+	if !s.opts.PinHostKeys {
+		return nil
+	}
+
+	return WriteFileAtomic(s.knownHostsPath, []byte(s.knownHostsLines()), 0640)
 }
 
-// WriteWorkloadHost writes a host entry that proxies through the bastion host.
-func (s *SSH) WriteWorkloadHost(address string, identity string) error {
-	identity, err := filepath.Abs(identity)
+// setHost adds or replaces a host block, and the inventory host if
+// there is one, and rewrites the files.
+func (s *SSH) setHost(h *Host, i *InventoryHost) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.config.SetHost(h)
+	if i != nil {
+		s.inventory.SetHost(i)
+	}
+
+	return s.flush()
+}
+
+// SetIdentityAgent makes subsequent host entries authenticate using
+// the ssh-agent listening on socket. In this case, the identity given
+// for each host should be the public key, so that SSH can select the
+// matching key from the agent.
+func (s *SSH) SetIdentityAgent(socket string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.identityAgent = socket
+}
+
+// SetCertificate makes subsequent host entries present the SSH user
+// certificate at path along with the identity.
+func (s *SSH) SetCertificate(path string) error {
+	path, err := filepath.Abs(path)
 	if err != nil {
 		return err
 	}
 
-	return s.append(func(fh *os.File) error {
-		_, err = fh.WriteString(
-			fmt.Sprintf(`
-Host %s
-  IdentityFile %s
-  ProxyCommand ssh -F %s -W %%h:%%p bastion
-`,
-				address, identity, s.configPath,
-			))
+	s.lock.Lock()
+	defer s.lock.Unlock()
 
-		return err
-	})
+	s.certificate = path
+	return nil
+}
+
+// addIdentities adds the directives that select the host identities.
+func (s *SSH) addIdentities(h *Host, identities []string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, i := range identities {
+		path, err := filepath.Abs(i)
+		if err != nil {
+			return err
+		}
+
+		h.Add(IdentityFile, path)
+	}
+
+	if s.certificate != "" {
+		h.Add(CertificateFile, s.certificate)
+	}
+
+	if s.identityAgent != "" {
+		h.Add(IdentitiesOnly, "yes")
+		h.Add(IdentityAgent, s.identityAgent)
+	}
+
+	return nil
+}
+
+// Entry describes a host entry.
+type Entry struct {
+	// Name is the host alias, before it is namespaced.
+	Name string
+	// Address is the host name or address that SSH connects to.
+	Address string
+	// Aliases are other names or addresses of a stack host, which its
+	// entry also matches outside a namespace.
+	Aliases []string
+	// User is the login user. If it is empty, SSH uses the local user.
+	User string
+	// Port is the SSH port. If it is zero, the default is used.
+	Port int
+	// Identities are the stack identities that the host accepts, in
+	// the order that SSH should try them. If there are none, SSH uses
+	// the user's own identities, e.g. for an external jump host.
+	Identities []string
+	// Jump are the names of the hosts to jump through to reach the
+	// host, in order. If there are none, SSH connects directly.
+	Jump []string
+	// ProxyCommand is the command that SSH uses to connect to the
+	// host, instead of connecting directly or jumping.
+	ProxyCommand string
+	// Multiplex is true if sessions to the host should share a single
+	// connection. This is worth doing for hosts that other hosts jump
+	// through.
+	Multiplex bool
+	// ControlPersist is how long a shared connection stays open after
+	// the last session closes. If it is zero, the default is 5m.
+	ControlPersist time.Duration
+	// ServerAliveInterval is how often to check that the host is still
+	// there. If it is zero, SSH doesn't check.
+	ServerAliveInterval time.Duration
+	// LocalForwards are LocalForward arguments, e.g. "8080 localhost:80".
+	LocalForwards []string
+	// RemoteForwards are RemoteForward arguments, e.g. "9000 localhost:9000".
+	RemoteForwards []string
+	// DynamicForwards are DynamicForward arguments, e.g. "1080".
+	DynamicForwards []string
+	// External is true if the host is not part of the stack, so its
+	// host key should be verified using the user's known_hosts file.
+	// External hosts are not added to the inventory.
+	External bool
+	// Groups are the inventory groups that the host belongs to.
+	Groups []string
+}
+
+// sshTime formats a duration in the ssh_config(5) time format.
+func sshTime(d time.Duration) string {
+	switch {
+	case d%time.Hour == 0:
+		return fmt.Sprintf("%dh", d/time.Hour)
+	case d%time.Minute == 0:
+		return fmt.Sprintf("%dm", d/time.Minute)
+	default:
+		return fmt.Sprintf("%d", d/time.Second)
+	}
+}
+
+// WriteHost writes the host entry. Outside a namespace, the entry for
+// a stack host also matches the host address and aliases, so that the
+// addresses in the stack outputs can be used with "ssh -F".
+func (s *SSH) WriteHost(e Entry) error {
+	h := NewHost(s.Alias(e.Name))
+	if s.opts.Namespace == "" && !e.External {
+		h.Patterns = append(h.Patterns, e.Address)
+		h.Patterns = append(h.Patterns, e.Aliases...)
+	}
+
+	h.Add(Hostname, e.Address)
+
+	if e.User != "" {
+		h.Add(User, e.User)
+	}
+
+	if e.Port != 0 {
+		h.Add(Port, strconv.Itoa(e.Port))
+	}
+
+	if len(e.Identities) > 0 {
+		if err := s.addIdentities(h, e.Identities); err != nil {
+			return err
+		}
+	}
+
+	if len(e.Jump) > 0 {
+		var jumps []string
+		for _, j := range e.Jump {
+			jumps = append(jumps, s.Alias(j))
+		}
+
+		h.Add(ProxyJump, strings.Join(jumps, ","))
+	}
+
+	if e.ProxyCommand != "" {
+		h.Add(ProxyCommand, e.ProxyCommand)
+	}
+
+	if e.Multiplex {
+		persist := 5 * time.Minute
+		if e.ControlPersist > 0 {
+			persist = e.ControlPersist
+		}
+
+		h.Add(ControlMaster, "auto")
+		h.Add(ControlPersist, sshTime(persist))
+		h.Add(ControlPath, fmt.Sprintf("%s/%%r@%%h:%%p", s.controlPath))
+	}
+
+	if e.ServerAliveInterval > 0 {
+		h.Add(ServerAliveInterval, strconv.Itoa(int(e.ServerAliveInterval/time.Second)))
+	}
+
+	for _, f := range e.LocalForwards {
+		h.Add(LocalForward, f)
+	}
+
+	for _, f := range e.RemoteForwards {
+		h.Add(RemoteForward, f)
+	}
+
+	for _, f := range e.DynamicForwards {
+		h.Add(DynamicForward, f)
+	}
+
+	if e.External {
+		h.Add(UserKnownHostsFile, "~/.ssh/known_hosts")
+		return s.setHost(h, nil)
+	}
+
+	return s.setHost(h, s.inventoryHost(h, e))
+}
+
+// inventoryHost returns the inventory host for a stack host. Ansible
+// connects to the host address, so the SSH arguments select this
+// configuration file and give the options that the host would get
+// from it when connecting by alias.
+func (s *SSH) inventoryHost(h *Host, e Entry) *InventoryHost {
+	i := &InventoryHost{
+		Name:   h.Name(),
+		Groups: e.Groups,
+		Vars: map[string]string{
+			"ansible_host": e.Address,
+		},
+	}
+
+	if e.User != "" {
+		i.Vars["ansible_user"] = e.User
+	}
+
+	if e.Port != 0 {
+		i.Vars["ansible_port"] = strconv.Itoa(e.Port)
+	}
+
+	if files := h.GetAll(IdentityFile); len(files) > 0 {
+		i.Vars["ansible_ssh_private_key_file"] = files[0]
+	}
+
+	args := []string{"-F", quoteWord(s.configPath)}
+
+	for _, d := range h.Directives {
+		switch {
+		case d.is(Hostname), d.is(User), d.is(Port), d.is(IdentityFile),
+			d.is(LocalForward), d.is(RemoteForward), d.is(DynamicForward):
+			// These are either host variables, or not needed by
+			// Ansible.
+		default:
+			args = append(args, "-o", quoteWord(fmt.Sprintf("%s=%s", d.Keyword, d.Value)))
+		}
+	}
+
+	for _, d := range s.config.Global.Directives {
+		args = append(args, "-o", quoteWord(fmt.Sprintf("%s=%s", d.Keyword, d.Value)))
+	}
+
+	i.Vars["ansible_ssh_common_args"] = strings.Join(args, " ")
+
+	return i
+}
+
+// WriteKnownHost adds the host key for address to the known_hosts file.
+func (s *SSH) WriteKnownHost(address string, key ssh.PublicKey) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.knownHosts[address] = knownhosts.Line([]string{address}, key)
+	return s.flush()
+}
+
+// naturalLess compares strings so that runs of digits are ordered by
+// their numeric value, e.g. "172.16.2.9" sorts before "172.16.2.10".
+func naturalLess(a string, b string) bool {
+	for a != "" && b != "" {
+		na, ra := leadingDigits(a)
+		nb, rb := leadingDigits(b)
+
+		// Both start with a number, so compare the numbers.
+		if len(ra) < len(a) && len(rb) < len(b) {
+			if len(na) != len(nb) {
+				return len(na) < len(nb)
+			}
+			if na != nb {
+				return na < nb
+			}
+
+			a, b = ra, rb
+			continue
+		}
+
+		if a[0] != b[0] {
+			return a[0] < b[0]
+		}
+
+		a, b = a[1:], b[1:]
+	}
+
+	return len(a) < len(b)
+}
+
+// leadingDigits splits s into its leading run of digits (without
+// leading zeros) and the remainder.
+func leadingDigits(s string) (string, string) {
+	i := 0
+	for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+		i++
+	}
+
+	return strings.TrimLeft(s[:i], "0"), s[i:]
 }
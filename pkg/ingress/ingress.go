@@ -0,0 +1,154 @@
+package ingress
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+// Auto is the source that stands for the caller's own public address.
+const Auto = "auto"
+
+// Anywhere is the source range that is allowed if none are configured.
+var Anywhere = netaddr.MustParseIPPrefix("0.0.0.0/0")
+
+// Resolver finds the public address of the caller.
+type Resolver interface {
+	Resolve(ctx context.Context) (netaddr.IP, error)
+}
+
+// HTTPResolver resolves the public address of the caller by fetching a
+// URL that responds with the address of the client, as plain text.
+type HTTPResolver struct {
+	URL string
+	// Client is the HTTP client. If it is nil, a client with a 10
+	// second timeout is used.
+	Client *http.Client
+}
+
+// DefaultResolverURL is the URL of the default resolver. It only
+// responds over IPv4.
+const DefaultResolverURL = "https://checkip.amazonaws.com"
+
+// DefaultResolver is the resolver for the Auto source.
+var DefaultResolver Resolver = &HTTPResolver{URL: DefaultResolverURL}
+
+// Resolve fetches the URL and parses the response as an IP address.
+func (r *HTTPResolver) Resolve(ctx context.Context) (netaddr.IP, error) {
+	client := r.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.URL, nil)
+	if err != nil {
+		return netaddr.IP{}, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return netaddr.IP{}, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return netaddr.IP{}, fmt.Errorf("%s: unexpected status %q", r.URL, resp.Status)
+	}
+
+	// The response is just an address, so don't read much of it.
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, 256))
+	if err != nil {
+		return netaddr.IP{}, fmt.Errorf("%s: %w", r.URL, err)
+	}
+
+	ip, err := netaddr.ParseIP(strings.TrimSpace(string(b)))
+	if err != nil {
+		return netaddr.IP{}, fmt.Errorf("%s: unexpected response: %w", r.URL, err)
+	}
+
+	return ip.Unmap(), nil
+}
+
+// Sources are the source address ranges to allow, by address family.
+// Firewalls generally need separate rules for each family.
+type Sources struct {
+	IPv4 []netaddr.IPPrefix
+	IPv6 []netaddr.IPPrefix
+}
+
+// Parse parses the source addresses, which may be address ranges,
+// single addresses, or Auto to resolve the public address of the caller
+// with resolver. If there are no values, the sources are Anywhere.
+func Parse(ctx context.Context, values []string, resolver Resolver) (*Sources, error) {
+	if len(values) == 0 {
+		return &Sources{IPv4: []netaddr.IPPrefix{Anywhere}}, nil
+	}
+
+	s := &Sources{}
+	seen := map[netaddr.IPPrefix]bool{}
+
+	for _, v := range values {
+		var p netaddr.IPPrefix
+
+		switch {
+		case v == Auto:
+			ip, err := resolver.Resolve(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("failed to resolve the public address: %w", err)
+			}
+
+			p = netaddr.IPPrefixFrom(ip, ip.BitLen())
+
+		case strings.Contains(v, "/"):
+			prefix, err := netaddr.ParseIPPrefix(v)
+			if err != nil {
+				return nil, err
+			}
+
+			if prefix != prefix.Masked() {
+				return nil, fmt.Errorf("%s is not a network prefix, did you mean %s?", prefix, prefix.Masked())
+			}
+
+			p = prefix
+
+		default:
+			ip, err := netaddr.ParseIP(v)
+			if err != nil {
+				return nil, err
+			}
+
+			p = netaddr.IPPrefixFrom(ip, ip.BitLen())
+		}
+
+		if seen[p] {
+			continue
+		}
+
+		seen[p] = true
+
+		if p.IP().Is4() {
+			s.IPv4 = append(s.IPv4, p)
+		} else {
+			s.IPv6 = append(s.IPv6, p)
+		}
+	}
+
+	return s, nil
+}
+
+// Strings returns the prefixes as strings.
+func Strings(prefixes []netaddr.IPPrefix) []string {
+	var s []string
+	for _, p := range prefixes {
+		s = append(s, p.String())
+	}
+
+	return s
+}
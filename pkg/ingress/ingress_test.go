@@ -0,0 +1,133 @@
+package ingress
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"inet.af/netaddr"
+)
+
+// standIn returns a server that responds to every request with status
+// and body.
+func standIn(t *testing.T, status int, body string) *HTTPResolver {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		fmt.Fprint(w, body)
+	}))
+	t.Cleanup(srv.Close)
+
+	return &HTTPResolver{URL: srv.URL, Client: srv.Client()}
+}
+
+func TestHTTPResolver(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+		want   string
+		err    string
+	}{
+		{"ipv4", http.StatusOK, "203.0.113.7", "203.0.113.7", ""},
+		{"ipv6", http.StatusOK, "2001:db8::7", "2001:db8::7", ""},
+		{"mapped", http.StatusOK, "::ffff:203.0.113.7", "203.0.113.7", ""},
+		{"whitespace", http.StatusOK, "\n  203.0.113.7 \r\n", "203.0.113.7", ""},
+		{"status", http.StatusServiceUnavailable, "203.0.113.7", "", "unexpected status"},
+		{"not an address", http.StatusOK, "<html>hello</html>", "", "unexpected response"},
+		{"empty", http.StatusOK, "", "", "unexpected response"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ip, err := standIn(t, tt.status, tt.body).Resolve(context.Background())
+
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got %s, %v, want error %q", ip, err, tt.err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if ip.String() != tt.want {
+				t.Errorf("got %s, want %s", ip, tt.want)
+			}
+		})
+	}
+}
+
+func TestParse(t *testing.T) {
+	resolver := &HTTPResolver{URL: "http://unused.invalid"}
+
+	tests := []struct {
+		name   string
+		values []string
+		ipv4   []string
+		ipv6   []string
+		err    string
+	}{
+		{"default", nil, []string{"0.0.0.0/0"}, nil, ""},
+		{"address", []string{"198.51.100.1"}, []string{"198.51.100.1/32"}, nil, ""},
+		{"range", []string{"198.51.100.0/24", "2001:db8::/32"}, []string{"198.51.100.0/24"}, []string{"2001:db8::/32"}, ""},
+		{"duplicate", []string{"198.51.100.1", "198.51.100.1/32"}, []string{"198.51.100.1/32"}, nil, ""},
+		{"unmasked", []string{"198.51.100.1/24"}, nil, nil, "did you mean 198.51.100.0/24"},
+		{"invalid", []string{"example.com"}, nil, nil, "ParseIP"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := Parse(context.Background(), tt.values, resolver)
+
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want %q", err, tt.err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := Strings(s.IPv4); !reflect.DeepEqual(got, tt.ipv4) {
+				t.Errorf("got IPv4 %v, want %v", got, tt.ipv4)
+			}
+
+			if got := Strings(s.IPv6); !reflect.DeepEqual(got, tt.ipv6) {
+				t.Errorf("got IPv6 %v, want %v", got, tt.ipv6)
+			}
+		})
+	}
+}
+
+func TestParseAuto(t *testing.T) {
+	s, err := Parse(context.Background(), []string{Auto, "10.0.0.0/8"}, standIn(t, http.StatusOK, "203.0.113.7\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []netaddr.IPPrefix{
+		netaddr.MustParseIPPrefix("203.0.113.7/32"),
+		netaddr.MustParseIPPrefix("10.0.0.0/8"),
+	}
+
+	if !reflect.DeepEqual(s.IPv4, want) {
+		t.Errorf("got %v, want %v", s.IPv4, want)
+	}
+
+	_, err = Parse(context.Background(), []string{Auto}, standIn(t, http.StatusInternalServerError, ""))
+	if err == nil || !strings.Contains(err.Error(), "failed to resolve the public address") {
+		t.Errorf("got error %v, want a resolve failure", err)
+	}
+}
@@ -0,0 +1,191 @@
+package ipam
+
+import (
+	"fmt"
+	"sort"
+
+	"inet.af/netaddr"
+)
+
+// Cloud describes the addresses that a cloud reserves in each subnet.
+type Cloud struct {
+	// Name is the cloud name, for error messages.
+	Name string
+	// MaxBits is the longest prefix length that a subnet can have.
+	MaxBits uint8
+	// Head is the number of addresses reserved at the start of the
+	// subnet, including the network address.
+	Head int
+	// Tail is the number of addresses reserved at the end of the
+	// subnet, including the broadcast address.
+	Tail int
+}
+
+// AWS reserves the network address, the VPC router, the DNS server, an
+// address for future use, and the broadcast address.
+//
+// See https://docs.aws.amazon.com/vpc/latest/userguide/subnet-sizing.html
+var AWS = Cloud{Name: "AWS", MaxBits: 28, Head: 4, Tail: 1}
+
+// GCP reserves the network address, the default gateway, the
+// second-to-last address, and the broadcast address.
+//
+// See https://cloud.google.com/vpc/docs/subnets#unusable-ip-addresses-in-every-subnet
+var GCP = Cloud{Name: "GCP", MaxBits: 29, Head: 2, Tail: 2}
+
+// Allocator hands out the addresses in a subnet. Addresses are handed
+// out in order, so allocating the same keys in the same order always
+// gives the same addresses.
+type Allocator struct {
+	cloud  Cloud
+	prefix netaddr.IPPrefix
+	first  netaddr.IP
+	last   netaddr.IP
+	keys   map[string]netaddr.IP
+	used   map[netaddr.IP]string
+	next   netaddr.IP
+}
+
+// New returns an allocator for the IPv4 subnet prefix in the cloud.
+func New(cloud Cloud, prefix netaddr.IPPrefix) (*Allocator, error) {
+	if !prefix.IsValid() || !prefix.IP().Is4() {
+		return nil, fmt.Errorf("subnet %s is not an IPv4 prefix", prefix)
+	}
+
+	if prefix.Bits() > cloud.MaxBits {
+		return nil, fmt.Errorf("subnet %s is smaller than the %s minimum of /%d",
+			prefix, cloud.Name, cloud.MaxBits)
+	}
+
+	prefix = prefix.Masked()
+	r := prefix.Range()
+
+	first := r.From()
+	for i := 0; i < cloud.Head; i++ {
+		first = first.Next()
+	}
+
+	last := r.To()
+	for i := 0; i < cloud.Tail; i++ {
+		last = last.Prior()
+	}
+
+	return &Allocator{
+		cloud:  cloud,
+		prefix: prefix,
+		first:  first,
+		last:   last,
+		keys:   map[string]netaddr.IP{},
+		used:   map[netaddr.IP]string{},
+		next:   first,
+	}, nil
+}
+
+// Prefix returns the subnet prefix.
+func (a *Allocator) Prefix() netaddr.IPPrefix {
+	return a.prefix
+}
+
+// Size returns the number of addresses that can be allocated in the
+// subnet.
+func (a *Allocator) Size() int {
+	return 1<<(32-int(a.prefix.Bits())) - a.cloud.Head - a.cloud.Tail
+}
+
+// Available returns the number of addresses that are not allocated.
+func (a *Allocator) Available() int {
+	return a.Size() - len(a.used)
+}
+
+// Reserved returns whether the cloud reserves the address.
+func (a *Allocator) Reserved(ip netaddr.IP) bool {
+	return a.prefix.Contains(ip) && (ip.Less(a.first) || a.last.Less(ip))
+}
+
+// Allocate returns the address for key, allocating the next free
+// address if key doesn't have one yet.
+func (a *Allocator) Allocate(key string) (netaddr.IP, error) {
+	if ip, ok := a.keys[key]; ok {
+		return ip, nil
+	}
+
+	for ip := a.next; !a.last.Less(ip); ip = ip.Next() {
+		if _, ok := a.used[ip]; ok {
+			continue
+		}
+
+		a.keys[key] = ip
+		a.used[ip] = key
+		a.next = ip.Next()
+
+		return ip, nil
+	}
+
+	return netaddr.IP{}, fmt.Errorf("subnet %s exhausted allocating %q", a.prefix, key)
+}
+
+// AllocateN allocates the addresses for the keys, in order. If there
+// are not enough addresses for all of the keys, none are allocated.
+func (a *Allocator) AllocateN(keys ...string) ([]netaddr.IP, error) {
+	needed := 0
+	for _, k := range keys {
+		if _, ok := a.keys[k]; !ok {
+			needed++
+		}
+	}
+
+	if needed > a.Available() {
+		return nil, fmt.Errorf("subnet %s has %d free addresses, but %d are needed",
+			a.prefix, a.Available(), needed)
+	}
+
+	var ips []netaddr.IP
+	for _, k := range keys {
+		ip, err := a.Allocate(k)
+		if err != nil {
+			return nil, err
+		}
+
+		ips = append(ips, ip)
+	}
+
+	return ips, nil
+}
+
+// Reserve allocates ip to key, e.g. for an address that is fixed by
+// other configuration.
+func (a *Allocator) Reserve(key string, ip netaddr.IP) error {
+	switch {
+	case !a.prefix.Contains(ip):
+		return fmt.Errorf("address %s for %q is not in subnet %s", ip, key, a.prefix)
+	case a.Reserved(ip):
+		return fmt.Errorf("address %s for %q is reserved by %s", ip, key, a.cloud.Name)
+	}
+
+	if other, ok := a.used[ip]; ok && other != key {
+		return fmt.Errorf("address %s for %q is already allocated to %q", ip, key, other)
+	}
+
+	if prev, ok := a.keys[key]; ok && prev != ip {
+		return fmt.Errorf("%q is already allocated address %s", key, prev)
+	}
+
+	a.keys[key] = ip
+	a.used[ip] = key
+
+	return nil
+}
+
+// Allocations returns the allocated keys, in address order.
+func (a *Allocator) Allocations() []string {
+	var keys []string
+	for k := range a.keys {
+		keys = append(keys, k)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return a.keys[keys[i]].Less(a.keys[keys[j]])
+	})
+
+	return keys
+}
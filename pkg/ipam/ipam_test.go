@@ -0,0 +1,193 @@
+package ipam
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"inet.af/netaddr"
+)
+
+func mustNew(t *testing.T, cloud Cloud, prefix string) *Allocator {
+	t.Helper()
+
+	a, err := New(cloud, netaddr.MustParseIPPrefix(prefix))
+	if err != nil {
+		t.Fatalf("New(%s, %s): %s", cloud.Name, prefix, err)
+	}
+
+	return a
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		cloud  Cloud
+		prefix string
+		err    string
+	}{
+		{AWS, "10.0.0.0/28", ""},
+		{AWS, "10.0.0.0/29", "smaller than the AWS minimum of /28"},
+		{GCP, "10.0.0.0/29", ""},
+		{GCP, "10.0.0.0/30", "smaller than the GCP minimum of /29"},
+		{AWS, "fd00::/64", "not an IPv4 prefix"},
+	}
+
+	for _, tt := range tests {
+		_, err := New(tt.cloud, netaddr.MustParseIPPrefix(tt.prefix))
+		if tt.err == "" && err != nil {
+			t.Errorf("New(%s, %s): %s", tt.cloud.Name, tt.prefix, err)
+		}
+
+		if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("New(%s, %s): got error %v, want %q", tt.cloud.Name, tt.prefix, err, tt.err)
+		}
+	}
+}
+
+func TestReserved(t *testing.T) {
+	tests := []struct {
+		cloud    Cloud
+		size     int
+		reserved []string
+		first    string
+	}{
+		{AWS, 11, []string{"10.0.0.0", "10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.15"}, "10.0.0.4"},
+		{GCP, 12, []string{"10.0.0.0", "10.0.0.1", "10.0.0.14", "10.0.0.15"}, "10.0.0.2"},
+	}
+
+	for _, tt := range tests {
+		a := mustNew(t, tt.cloud, "10.0.0.0/28")
+
+		if a.Size() != tt.size {
+			t.Errorf("%s: got size %d, want %d", tt.cloud.Name, a.Size(), tt.size)
+		}
+
+		var reserved []string
+		for ip := a.Prefix().Range().From(); a.Prefix().Contains(ip); ip = ip.Next() {
+			if a.Reserved(ip) {
+				reserved = append(reserved, ip.String())
+			}
+		}
+
+		if !reflect.DeepEqual(reserved, tt.reserved) {
+			t.Errorf("%s: got reserved %v, want %v", tt.cloud.Name, reserved, tt.reserved)
+		}
+
+		ip, err := a.Allocate("first")
+		if err != nil || ip.String() != tt.first {
+			t.Errorf("%s: got first address %s (%v), want %s", tt.cloud.Name, ip, err, tt.first)
+		}
+	}
+}
+
+func TestAllocateDeterministic(t *testing.T) {
+	keys := []string{"workload-0", "workload-1", "workload-2"}
+	want := []netaddr.IP{
+		netaddr.MustParseIP("172.16.2.4"),
+		netaddr.MustParseIP("172.16.2.5"),
+		netaddr.MustParseIP("172.16.2.6"),
+	}
+
+	for run := 0; run < 2; run++ {
+		a := mustNew(t, AWS, "172.16.2.0/24")
+
+		got, err := a.AllocateN(keys...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("run %d: got %v, want %v", run, got, want)
+		}
+
+		// Allocating a key again returns the same address.
+		ip, err := a.Allocate("workload-1")
+		if err != nil || ip != want[1] {
+			t.Errorf("run %d: reallocating got %s (%v), want %s", run, ip, err, want[1])
+		}
+
+		if a.Available() != a.Size()-len(keys) {
+			t.Errorf("run %d: got %d available, want %d", run, a.Available(), a.Size()-len(keys))
+		}
+	}
+}
+
+func TestAllocateNExhausted(t *testing.T) {
+	a := mustNew(t, AWS, "10.0.0.0/28")
+
+	if _, err := a.AllocateN("a", "b", "c"); err != nil {
+		t.Fatal(err)
+	}
+
+	var keys []string
+	for i := 0; i < a.Available()+1; i++ {
+		keys = append(keys, fmt.Sprintf("k%d", i))
+	}
+
+	_, err := a.AllocateN(keys...)
+	if err == nil || !strings.Contains(err.Error(), "8 free addresses, but 9 are needed") {
+		t.Fatalf("got error %v, want exhaustion", err)
+	}
+
+	// Nothing was allocated by the failed call.
+	if got := a.Allocations(); !reflect.DeepEqual(got, []string{"a", "b", "c"}) {
+		t.Errorf("got allocations %v, want [a b c]", got)
+	}
+
+	// Keys that are already allocated don't need new addresses.
+	if _, err := a.AllocateN(append([]string{"a", "b", "c"}, keys[:8]...)...); err != nil {
+		t.Errorf("allocating the remaining addresses: %s", err)
+	}
+
+	if _, err := a.Allocate("more"); err == nil {
+		t.Errorf("allocating from a full subnet succeeded")
+	}
+}
+
+func TestReserve(t *testing.T) {
+	a := mustNew(t, AWS, "10.0.0.0/28")
+
+	if err := a.Reserve("gateway", netaddr.MustParseIP("10.0.0.5")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reserving the same address again is fine.
+	if err := a.Reserve("gateway", netaddr.MustParseIP("10.0.0.5")); err != nil {
+		t.Errorf("reserving again: %s", err)
+	}
+
+	// Allocation skips the reserved address.
+	ips, err := a.AllocateN("a", "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []netaddr.IP{netaddr.MustParseIP("10.0.0.4"), netaddr.MustParseIP("10.0.0.6")}
+	if !reflect.DeepEqual(ips, want) {
+		t.Errorf("got %v, want %v", ips, want)
+	}
+
+	if got := a.Allocations(); !reflect.DeepEqual(got, []string{"a", "gateway", "b"}) {
+		t.Errorf("got allocations %v, want [a gateway b]", got)
+	}
+
+	errors := []struct {
+		key string
+		ip  string
+		err string
+	}{
+		{"x", "10.0.1.4", "not in subnet"},
+		{"x", "10.0.0.2", "reserved by AWS"},
+		{"x", "10.0.0.15", "reserved by AWS"},
+		{"x", "10.0.0.4", `already allocated to "a"`},
+		{"gateway", "10.0.0.7", "already allocated address 10.0.0.5"},
+	}
+
+	for _, tt := range errors {
+		err := a.Reserve(tt.key, netaddr.MustParseIP(tt.ip))
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("Reserve(%s, %s): got error %v, want %q", tt.key, tt.ip, err, tt.err)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package ipam
+
+import (
+	"fmt"
+
+	"inet.af/netaddr"
+)
+
+// SubnetRequest is a subnet to lay out in a network. A request either
+// gives the subnet prefix, or the prefix length of a subnet to carve
+// from the free space in the network.
+type SubnetRequest struct {
+	Name   string
+	Prefix netaddr.IPPrefix
+	Bits   uint8
+}
+
+// Layout returns the prefixes of the requested subnets of network, in
+// request order. It checks that the given prefixes are inside the
+// network and don't overlap, then carves the remaining subnets from the
+// free space, in request order. Carving is deterministic, but removing
+// a carved subnet can move the subnets carved after it.
+func Layout(cloud Cloud, network netaddr.IPPrefix, reqs []SubnetRequest) ([]netaddr.IPPrefix, error) {
+	if !network.IsValid() || !network.IP().Is4() {
+		return nil, fmt.Errorf("network %s is not an IPv4 prefix", network)
+	}
+
+	if network.Bits() > cloud.MaxBits {
+		return nil, fmt.Errorf("network %s is smaller than the %s minimum of /%d",
+			network, cloud.Name, cloud.MaxBits)
+	}
+
+	network = network.Masked()
+	prefixes := make([]netaddr.IPPrefix, len(reqs))
+
+	var free netaddr.IPSetBuilder
+	free.AddPrefix(network)
+
+	for i, r := range reqs {
+		if !r.Prefix.IsValid() {
+			continue
+		}
+
+		switch {
+		case r.Prefix != r.Prefix.Masked():
+			return nil, fmt.Errorf("subnet %q: %s is not a network prefix, did you mean %s?",
+				r.Name, r.Prefix, r.Prefix.Masked())
+		case r.Prefix.Bits() < network.Bits() || !network.Contains(r.Prefix.IP()):
+			return nil, fmt.Errorf("subnet %q: %s is not inside network %s", r.Name, r.Prefix, network)
+		case r.Prefix.Bits() > cloud.MaxBits:
+			return nil, fmt.Errorf("subnet %q: %s is smaller than the %s minimum of /%d",
+				r.Name, r.Prefix, cloud.Name, cloud.MaxBits)
+		}
+
+		for j := 0; j < i; j++ {
+			if prefixes[j].IsValid() && prefixes[j].Overlaps(r.Prefix) {
+				return nil, fmt.Errorf("subnet %q: %s overlaps subnet %q (%s)",
+					r.Name, r.Prefix, reqs[j].Name, prefixes[j])
+			}
+		}
+
+		prefixes[i] = r.Prefix
+		free.RemovePrefix(r.Prefix)
+	}
+
+	space, err := free.IPSet()
+	if err != nil {
+		return nil, err
+	}
+
+	for i, r := range reqs {
+		if prefixes[i].IsValid() {
+			continue
+		}
+
+		switch {
+		case r.Bits < network.Bits():
+			return nil, fmt.Errorf("subnet %q: /%d is larger than network %s", r.Name, r.Bits, network)
+		case r.Bits > cloud.MaxBits:
+			return nil, fmt.Errorf("subnet %q: /%d is smaller than the %s minimum of /%d",
+				r.Name, r.Bits, cloud.Name, cloud.MaxBits)
+		}
+
+		p, rest, ok := space.RemoveFreePrefix(r.Bits)
+		if !ok {
+			return nil, fmt.Errorf("subnet %q: no room for a /%d in network %s", r.Name, r.Bits, network)
+		}
+
+		prefixes[i] = p
+		space = rest
+	}
+
+	return prefixes, nil
+}
@@ -0,0 +1,145 @@
+package ipam
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"inet.af/netaddr"
+)
+
+// fixed requests the given subnet prefix.
+func fixed(name string, prefix string) SubnetRequest {
+	return SubnetRequest{Name: name, Prefix: netaddr.MustParseIPPrefix(prefix)}
+}
+
+// sized requests a subnet of the given prefix length.
+func sized(name string, bits uint8) SubnetRequest {
+	return SubnetRequest{Name: name, Bits: bits}
+}
+
+func TestLayout(t *testing.T) {
+	tests := []struct {
+		name    string
+		cloud   Cloud
+		network string
+		reqs    []SubnetRequest
+		want    []string
+		err     string
+	}{{
+		name:    "default",
+		cloud:   AWS,
+		network: "172.16.0.0/16",
+		reqs:    []SubnetRequest{fixed("dmz", "172.16.1.0/24"), fixed("workload", "172.16.2.0/24")},
+		want:    []string{"172.16.1.0/24", "172.16.2.0/24"},
+	}, {
+		name:    "carved in order around fixed subnets",
+		cloud:   AWS,
+		network: "10.40.0.0/16",
+		reqs:    []SubnetRequest{fixed("dmz", "10.40.0.0/24"), sized("workload", 20), sized("dmz-1", 24), sized("workload-1", 20)},
+		want:    []string{"10.40.0.0/24", "10.40.16.0/20", "10.40.1.0/24", "10.40.32.0/20"},
+	}, {
+		name:    "fixed subnets are placed before carving",
+		cloud:   GCP,
+		network: "10.0.0.0/24",
+		reqs:    []SubnetRequest{sized("a", 26), fixed("b", "10.0.0.0/26")},
+		want:    []string{"10.0.0.64/26", "10.0.0.0/26"},
+	}, {
+		name:    "whole network",
+		cloud:   AWS,
+		network: "10.0.0.0/24",
+		reqs:    []SubnetRequest{sized("all", 24)},
+		want:    []string{"10.0.0.0/24"},
+	}, {
+		name:    "unmasked network is masked",
+		cloud:   AWS,
+		network: "10.0.0.7/24",
+		reqs:    []SubnetRequest{sized("a", 25)},
+		want:    []string{"10.0.0.0/25"},
+	}, {
+		name:    "ipv6 network",
+		cloud:   AWS,
+		network: "fd00::/48",
+		err:     "not an IPv4 prefix",
+	}, {
+		name:    "network too small",
+		cloud:   AWS,
+		network: "10.0.0.0/29",
+		err:     "smaller than the AWS minimum of /28",
+	}, {
+		name:    "unmasked subnet",
+		cloud:   AWS,
+		network: "10.0.0.0/16",
+		reqs:    []SubnetRequest{fixed("a", "10.0.1.1/24")},
+		err:     `subnet "a": 10.0.1.1/24 is not a network prefix, did you mean 10.0.1.0/24?`,
+	}, {
+		name:    "subnet outside the network",
+		cloud:   AWS,
+		network: "10.0.0.0/16",
+		reqs:    []SubnetRequest{fixed("a", "10.1.0.0/24")},
+		err:     `subnet "a": 10.1.0.0/24 is not inside network 10.0.0.0/16`,
+	}, {
+		name:    "subnet larger than the network",
+		cloud:   AWS,
+		network: "10.0.0.0/16",
+		reqs:    []SubnetRequest{fixed("a", "10.0.0.0/8")},
+		err:     `subnet "a": 10.0.0.0/8 is not inside network 10.0.0.0/16`,
+	}, {
+		name:    "fixed subnet too small",
+		cloud:   AWS,
+		network: "10.0.0.0/16",
+		reqs:    []SubnetRequest{fixed("a", "10.0.0.0/29")},
+		err:     `subnet "a": 10.0.0.0/29 is smaller than the AWS minimum of /28`,
+	}, {
+		name:    "overlapping subnets",
+		cloud:   AWS,
+		network: "10.0.0.0/16",
+		reqs:    []SubnetRequest{fixed("a", "10.0.0.0/23"), fixed("b", "10.0.1.0/24")},
+		err:     `subnet "b": 10.0.1.0/24 overlaps subnet "a" (10.0.0.0/23)`,
+	}, {
+		name:    "sized subnet larger than the network",
+		cloud:   AWS,
+		network: "10.0.0.0/16",
+		reqs:    []SubnetRequest{sized("a", 15)},
+		err:     `subnet "a": /15 is larger than network 10.0.0.0/16`,
+	}, {
+		name:    "sized subnet too small",
+		cloud:   GCP,
+		network: "10.0.0.0/16",
+		reqs:    []SubnetRequest{sized("a", 30)},
+		err:     `subnet "a": /30 is smaller than the GCP minimum of /29`,
+	}, {
+		name:    "no room",
+		cloud:   AWS,
+		network: "10.0.0.0/24",
+		reqs:    []SubnetRequest{fixed("a", "10.0.0.0/25"), sized("b", 25), sized("c", 28)},
+		err:     `subnet "c": no room for a /28 in network 10.0.0.0/24`,
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Layout(tt.cloud, netaddr.MustParseIPPrefix(tt.network), tt.reqs)
+
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got %v, %v, want error %q", got, err, tt.err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var prefixes []string
+			for _, p := range got {
+				prefixes = append(prefixes, p.String())
+			}
+
+			if !reflect.DeepEqual(prefixes, tt.want) {
+				t.Errorf("got %v, want %v", prefixes, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,46 @@
+package keys
+
+import (
+	"errors"
+	"net"
+	"os"
+	"time"
+
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// PassphraseEnv is the environment variable that holds the passphrase
+// for an encrypted identity file.
+const PassphraseEnv = "SSH_IDENTITY_PASSPHRASE"
+
+// AgentSocket returns the path to the running ssh-agent socket.
+func AgentSocket() (string, error) {
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if sock == "" {
+		return "", errors.New("SSH_AUTH_SOCK is not set, is ssh-agent running?")
+	}
+
+	return sock, nil
+}
+
+// AddToAgent adds the private key to the running ssh-agent. If lifetime
+// is non-zero, the agent will forget the key after that duration.
+func AddToAgent(key interface{}, comment string, lifetime time.Duration) error {
+	sock, err := AgentSocket()
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		return err
+	}
+
+	defer conn.Close()
+
+	return agent.NewClient(conn).Add(agent.AddedKey{
+		PrivateKey:   key,
+		Comment:      comment,
+		LifetimeSecs: uint32(lifetime.Seconds()),
+	})
+}
@@ -0,0 +1,129 @@
+package keys
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// clockSkew is how far back to date certificates, in case the clocks
+// on the hosts are behind.
+const clockSkew = 5 * time.Minute
+
+// CertificatePath returns the path of the certificate for the private
+// key at path. This is the path that ssh(1) checks by default.
+func CertificatePath(path string) string {
+	return strings.TrimSuffix(path, filepath.Ext(path)) + "-cert.pub"
+}
+
+// SignUserCertificate uses the CA to sign a user certificate for key,
+// valid for the given principals (login users) from now until the end
+// of the validity period.
+func SignUserCertificate(
+	ca ssh.Signer,
+	key ssh.PublicKey,
+	keyID string,
+	principals []string,
+	validity time.Duration,
+) (*ssh.Certificate, error) {
+	var serial [8]byte
+	if _, err := rand.Read(serial[:]); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+
+	cert := &ssh.Certificate{
+		Key:             key,
+		Serial:          binary.BigEndian.Uint64(serial[:]),
+		CertType:        ssh.UserCert,
+		KeyId:           keyID,
+		ValidPrincipals: principals,
+		ValidAfter:      uint64(now.Add(-clockSkew).Unix()),
+		ValidBefore:     uint64(now.Add(validity).Unix()),
+		Permissions: ssh.Permissions{
+			Extensions: map[string]string{
+				"permit-X11-forwarding":   "",
+				"permit-agent-forwarding": "",
+				"permit-port-forwarding":  "",
+				"permit-pty":              "",
+				"permit-user-rc":          "",
+			},
+		},
+	}
+
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		return nil, err
+	}
+
+	return cert, nil
+}
+
+// ReadCertificate reads a certificate in authorized_keys format from
+// the file named by path.
+func ReadCertificate(path string) (*ssh.Certificate, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	key, _, _, _, err := ssh.ParseAuthorizedKey(b)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, ok := key.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("%q is not a certificate", path)
+	}
+
+	return cert, nil
+}
+
+// WriteCertificate writes the certificate to the file named by path,
+// in authorized_keys format.
+func WriteCertificate(path string, cert *ssh.Certificate) error {
+	return ioutil.WriteFile(path, ssh.MarshalAuthorizedKey(cert), 0644)
+}
+
+// NeedsRenewal returns whether the certificate at path needs to be
+// (re-)issued. This is the case if it doesn't exist, was not issued by
+// the CA for key and principals, or has less than half of the validity
+// period left.
+func NeedsRenewal(
+	path string,
+	ca ssh.PublicKey,
+	key ssh.PublicKey,
+	principals []string,
+	validity time.Duration,
+) (bool, error) {
+	cert, err := ReadCertificate(path)
+	if os.IsNotExist(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if !sameKey(cert.SignatureKey, ca) || !sameKey(cert.Key, key) {
+		return true, nil
+	}
+
+	if strings.Join(cert.ValidPrincipals, ",") != strings.Join(principals, ",") {
+		return true, nil
+	}
+
+	expiry := time.Unix(int64(cert.ValidBefore), 0)
+	return time.Until(expiry) < validity/2, nil
+}
+
+func sameKey(a ssh.PublicKey, b ssh.PublicKey) bool {
+	return string(a.Marshal()) == string(b.Marshal())
+}
@@ -0,0 +1,30 @@
+package keys
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// LoadHostKey reads an Ed25519 SSH host key from path, generating a new
+// key there if it doesn't exist. It returns the PEM-encoded private key
+// and the public key. Host keys are never encrypted, since they have to
+// be installed on the host.
+func LoadHostKey(path string) ([]byte, ssh.PublicKey, error) {
+	pub, err := NewPublicKey(path, Ed25519)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if pub.Type() != ssh.KeyAlgoED25519 {
+		return nil, nil, fmt.Errorf("%q is not an Ed25519 key", path)
+	}
+
+	priv, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return priv, pub, nil
+}
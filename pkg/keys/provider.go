@@ -0,0 +1,72 @@
+package keys
+
+import (
+	"fmt"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Constraint describes the SSH keys that a cloud provider will accept.
+type Constraint struct {
+	Provider   string
+	Algorithms []Algorithm
+	// RSAMinBits is the size of the smallest RSA key that the provider
+	// accepts. If it is zero, only the RSA sizes in Algorithms are
+	// accepted.
+	RSAMinBits int
+}
+
+// AWS is the constraint for EC2 key pairs. EC2 imports RSA and Ed25519
+// keys, but not ECDSA keys.
+//
+// See https://docs.aws.amazon.com/AWSEC2/latest/UserGuide/create-key-pairs.html
+var AWS = Constraint{
+	Provider:   "aws",
+	Algorithms: []Algorithm{RSA3072, RSA4096, Ed25519},
+	RSAMinBits: 2048,
+}
+
+// GCP is the constraint for GCP instance metadata keys.
+//
+// IMPORTANT: For GCP it has to be 3072 bit key. When we tried to use 2048
+// or 4096, it was not adding it to the authorized_keys file on cluster
+// nodes, even if the key was present in a gcp console (in node's
+// metadata).
+var GCP = Constraint{
+	Provider:   "gcp",
+	Algorithms: []Algorithm{RSA3072},
+}
+
+// Allows returns whether the provider accepts keys of the given algorithm.
+func (c Constraint) Allows(alg Algorithm) bool {
+	for _, a := range c.Algorithms {
+		if a == alg {
+			return true
+		}
+	}
+
+	bits := alg.RSABits()
+	return bits > 0 && c.RSAMinBits > 0 && bits >= c.RSAMinBits
+}
+
+// Check returns an error if the provider doesn't accept the given key.
+func (c Constraint) Check(key ssh.PublicKey) error {
+	alg, err := AlgorithmOf(key)
+	if err != nil {
+		return err
+	}
+
+	if !c.Allows(alg) {
+		return fmt.Errorf("%s does not accept %s keys", c.Provider, alg)
+	}
+
+	return nil
+}
+
+// MetadataSSHKey formats the public key as an entry in the "ssh-keys"
+// GCP instance metadata value, which authorizes the key for user.
+//
+// See https://cloud.google.com/compute/docs/connect/add-ssh-keys#metadata
+func MetadataSSHKey(user string, key ssh.PublicKey) string {
+	return fmt.Sprintf("%s:%s %s", user, MarshalAuthorizedKey(key), user)
+}
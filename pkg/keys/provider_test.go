@@ -0,0 +1,173 @@
+package keys
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// testKey returns a fixed Ed25519 public key and its base64 encoding.
+func testKey(t *testing.T) (ssh.PublicKey, string) {
+	t.Helper()
+
+	priv := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{7}, ed25519.SeedSize))
+
+	pub, err := ssh.NewPublicKey(priv.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pub, base64.StdEncoding.EncodeToString(pub.Marshal())
+}
+
+func TestProviderFormats(t *testing.T) {
+	key, b64 := testKey(t)
+
+	tests := []struct {
+		name string
+		got  string
+		want string
+	}{
+		{"aws authorized_keys", MarshalAuthorizedKey(key), "ssh-ed25519 " + b64},
+		{"authorized_keys with comment", MarshalAuthorizedKeyWithComment(key, "jpeach-aws-devel-dev"), "ssh-ed25519 " + b64 + " jpeach-aws-devel-dev"},
+		{"authorized_keys without comment", MarshalAuthorizedKeyWithComment(key, ""), "ssh-ed25519 " + b64},
+		{"gcp metadata", MetadataSSHKey("jpeach", key), "jpeach:ssh-ed25519 " + b64 + " jpeach"},
+	}
+
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, tt.got, tt.want)
+		}
+
+		if strings.HasSuffix(tt.got, "\n") {
+			t.Errorf("%s: has a trailing newline", tt.name)
+		}
+	}
+}
+
+func TestParsePublicKey(t *testing.T) {
+	key, b64 := testKey(t)
+
+	tests := []struct {
+		name    string
+		in      string
+		comment string
+		err     bool
+	}{
+		{"authorized_keys", "ssh-ed25519 " + b64, "", false},
+		{"authorized_keys with comment", "ssh-ed25519 " + b64 + " jpeach-gcp-devel-dev\n", "jpeach-gcp-devel-dev", false},
+		{"legacy bare base64", b64, "", false},
+		{"legacy bare base64 with newline", b64 + "\n", "", false},
+		{"garbage", "not a key", "", true},
+		{"base64 of garbage", base64.StdEncoding.EncodeToString([]byte("not a key")), "", true},
+	}
+
+	for _, tt := range tests {
+		got, comment, err := ParsePublicKey(tt.in)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%s: parsed, want an error", tt.name)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+
+		if !bytes.Equal(got.Marshal(), key.Marshal()) {
+			t.Errorf("%s: parsed a different key", tt.name)
+		}
+
+		if comment != tt.comment {
+			t.Errorf("%s: got comment %q, want %q", tt.name, comment, tt.comment)
+		}
+	}
+
+	// The metadata form round trips through the key part.
+	entry := MetadataSSHKey("jpeach", key)
+	got, comment, err := ParsePublicKey(strings.TrimPrefix(entry, "jpeach:"))
+	if err != nil || !bytes.Equal(got.Marshal(), key.Marshal()) || comment != "jpeach" {
+		t.Errorf("metadata round trip: got %v, %q, %v", got, comment, err)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	publicKey := func(priv interface{}, err error) ssh.PublicKey {
+		t.Helper()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		pub, err := PublicKeyOf(priv)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return pub
+	}
+
+	rsa1024 := publicKey(rsa.GenerateKey(rand.Reader, 1024))
+	rsa2048 := publicKey(rsa.GenerateKey(rand.Reader, 2048))
+	rsa3072 := publicKey(rsa.GenerateKey(rand.Reader, 3072))
+	p256 := publicKey(ecdsa.GenerateKey(elliptic.P256(), rand.Reader))
+	p384 := publicKey(ecdsa.GenerateKey(elliptic.P384(), rand.Reader))
+	_, edPriv, err := ed25519.GenerateKey(rand.Reader)
+	ed := publicKey(edPriv, err)
+
+	tests := []struct {
+		name  string
+		c     Constraint
+		key   ssh.PublicKey
+		alg   Algorithm
+		allow bool
+	}{
+		{"aws rsa-1024", AWS, rsa1024, "rsa-1024", false},
+		{"aws rsa-2048", AWS, rsa2048, "rsa-2048", true},
+		{"aws rsa-3072", AWS, rsa3072, RSA3072, true},
+		{"aws ecdsa", AWS, p256, ECDSAP256, false},
+		{"aws ed25519", AWS, ed, Ed25519, true},
+		{"gcp rsa-2048", GCP, rsa2048, "rsa-2048", false},
+		{"gcp rsa-3072", GCP, rsa3072, RSA3072, true},
+		{"gcp ed25519", GCP, ed, Ed25519, false},
+	}
+
+	for _, tt := range tests {
+		alg, err := AlgorithmOf(tt.key)
+		if err != nil || alg != tt.alg {
+			t.Errorf("%s: got algorithm %q (%v), want %q", tt.name, alg, err, tt.alg)
+		}
+
+		err = tt.c.Check(tt.key)
+		if tt.allow && err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+		}
+
+		if !tt.allow && err == nil {
+			t.Errorf("%s: accepted, want an error", tt.name)
+		}
+	}
+
+	if _, err := AlgorithmOf(p384); err == nil {
+		t.Errorf("ecdsa-p384: got an algorithm, want an error")
+	}
+
+	if bits := Algorithm("rsa-2048").RSABits(); bits != 2048 {
+		t.Errorf("got %d RSA bits, want 2048", bits)
+	}
+
+	if bits := Ed25519.RSABits(); bits != 0 {
+		t.Errorf("got %d RSA bits for ed25519, want 0", bits)
+	}
+}
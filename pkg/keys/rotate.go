@@ -0,0 +1,139 @@
+package keys
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Rotation describes the state of a key rotation.
+type Rotation struct {
+	// Previous is the path of the key that is being retired. It is
+	// empty unless this update is in the overlap window of a
+	// rotation, which lasts until the new key is deployed.
+	Previous string
+	// Token is the token of the last rotation, which is recorded in
+	// the deployed file once the new key is on all the hosts.
+	Token string
+	// Pending is true if a rotation was requested, but not performed
+	// because this was a dry run.
+	Pending bool
+	// Retired is true if the previous key was retired, or would have
+	// been if this wasn't a dry run.
+	Retired bool
+}
+
+// RotationPaths returns the paths of the retired key, of the file that
+// records the last rotation token for the key at path, and of the file
+// that records the last rotation that was deployed to the hosts.
+func RotationPaths(path string) (previous string, token string, deployed string) {
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext)
+
+	return base + ".previous" + ext, base + ".rotation", base + ".deployed"
+}
+
+// PublicKeyPath returns the path to write the public key for the
+// private key at path.
+func PublicKeyPath(path string) string {
+	return strings.TrimSuffix(path, filepath.Ext(path)) + ".pub"
+}
+
+// RotateFile rotates the private key at path whenever token differs
+// from the token of the last rotation. The current key is moved aside
+// and replaced by a newly generated key, and both keys should be
+// deployed until the new key is on all the hosts. Once the deployed
+// file (see RotationPaths) records the token of the last rotation, the
+// previous key is removed.
+//
+// A new rotation can't start while the previous key is still needed,
+// since some hosts might only trust that key.
+//
+// If dryRun is true, no files are changed.
+func RotateFile(path string, token string, alg Algorithm, passphrase []byte, dryRun bool) (*Rotation, error) {
+	previousPath, tokenPath, deployedPath := RotationPaths(path)
+
+	last, err := readToken(tokenPath)
+	if err != nil {
+		return nil, err
+	}
+
+	deployed, err := readToken(deployedPath)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Rotation{Token: last}
+
+	haveCurrent := exists(path)
+	havePrevious := exists(previousPath)
+
+	// The last rotation was deployed, so retire the previous key.
+	if havePrevious && last != "" && deployed == last {
+		r.Retired = true
+		havePrevious = false
+
+		if !dryRun {
+			for _, p := range []string{previousPath, PublicKeyPath(previousPath), deployedPath} {
+				if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	// A new rotation was requested.
+	if token != "" && token != last {
+		if havePrevious {
+			return nil, fmt.Errorf("%s: rotation %q has not been deployed to all the hosts yet, "+
+				"so set the rotation back to %q and update the stack to finish it before starting %q",
+				path, last, last, token)
+		}
+
+		if dryRun {
+			r.Pending = true
+			return r, nil
+		}
+
+		if haveCurrent {
+			if err := os.Rename(path, previousPath); err != nil {
+				return nil, err
+			}
+		}
+
+		if err := GeneratePrivateKeyWithPassphrase(path, alg, passphrase); err != nil {
+			return nil, err
+		}
+
+		if err := ioutil.WriteFile(tokenPath, []byte(token+"\n"), 0600); err != nil {
+			return nil, err
+		}
+
+		r.Token = token
+		havePrevious = haveCurrent
+	}
+
+	if havePrevious {
+		r.Previous = previousPath
+	}
+
+	return r, nil
+}
+
+// readToken reads the rotation token from the file at path. A missing
+// file has the empty token.
+func readToken(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+
+	return strings.TrimSpace(string(b)), err
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,104 @@
+package keys
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestRotateFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "identity.pem")
+	previousPath, _, deployedPath := RotationPaths(path)
+
+	read := func(p string) []byte {
+		t.Helper()
+
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return b
+	}
+
+	rotate := func(token string, dryRun bool) *Rotation {
+		t.Helper()
+
+		r, err := RotateFile(path, token, Ed25519, nil, dryRun)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return r
+	}
+
+	// Without a rotation, there's nothing to do.
+	if r := rotate("", false); *r != (Rotation{}) || exists(path) {
+		t.Fatalf("got %+v", *r)
+	}
+
+	if err := GeneratePrivateKey(path, Ed25519); err != nil {
+		t.Fatal(err)
+	}
+
+	original := read(path)
+
+	if r := rotate("one", true); *r != (Rotation{Pending: true}) || !bytes.Equal(read(path), original) {
+		t.Fatalf("dry run got %+v", *r)
+	}
+
+	if r := rotate("one", false); *r != (Rotation{Previous: previousPath, Token: "one"}) {
+		t.Fatalf("got %+v", *r)
+	}
+
+	if !bytes.Equal(read(previousPath), original) || bytes.Equal(read(path), original) {
+		t.Fatalf("the key wasn't rotated")
+	}
+
+	rotated := read(path)
+
+	// The rotation wasn't deployed, e.g. because the update failed,
+	// so the previous key stays.
+	if r := rotate("one", false); *r != (Rotation{Previous: previousPath, Token: "one"}) || !exists(previousPath) {
+		t.Fatalf("undeployed rotation got %+v", *r)
+	}
+
+	// Another rotation can't start until this one is deployed.
+	if _, err := RotateFile(path, "two", Ed25519, nil, false); err == nil {
+		t.Fatalf("started a rotation before the last one was deployed")
+	}
+
+	if err := ioutil.WriteFile(deployedPath, []byte("one\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if r := rotate("one", true); *r != (Rotation{Token: "one", Retired: true}) || !exists(previousPath) {
+		t.Fatalf("dry run got %+v", *r)
+	}
+
+	if r := rotate("one", false); *r != (Rotation{Token: "one", Retired: true}) {
+		t.Fatalf("got %+v", *r)
+	}
+
+	if exists(previousPath) || exists(deployedPath) || !bytes.Equal(read(path), rotated) {
+		t.Fatalf("the previous key wasn't retired")
+	}
+
+	// Retiring and rotating can happen in the same update.
+	if r := rotate("two", false); *r != (Rotation{Previous: previousPath, Token: "two"}) || !bytes.Equal(read(previousPath), rotated) {
+		t.Fatalf("got %+v", *r)
+	}
+
+	if err := ioutil.WriteFile(deployedPath, []byte("two\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if r := rotate("three", false); *r != (Rotation{Previous: previousPath, Token: "three", Retired: true}) {
+		t.Fatalf("got %+v", *r)
+	}
+
+	if bytes.Equal(read(previousPath), rotated) {
+		t.Fatalf("the retired key is still the previous key")
+	}
+}
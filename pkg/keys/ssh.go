@@ -1,54 +1,252 @@
 package keys
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
+	"encoding/base64"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"strings"
 
 	"golang.org/x/crypto/ssh"
 )
 
-// KeyBits is the default key size to generate, in bits.
-//
-// IMPORTANT: For GCP it has to be 3072 bit key. When we tried to use 2048
-// or 4096, it was not adding it to the authorized_keys file on cluster
-// nodes, even if the key was present in a gcp console (in node's
-// metadata).
-const KeyBits = 3072
-
-// GeneratePrivateKey generates a new RSA private kwy, writing it to
-// the file named by path.
-func GeneratePrivateKey(path string) error {
-	priv, err := rsa.GenerateKey(rand.Reader, KeyBits)
+// Algorithm names a type and size of key. The Algorithms are the ones
+// that we can generate, but existing RSA keys of any size have an
+// Algorithm given by RSA.
+type Algorithm string
+
+const (
+	// RSA3072 is a 3072 bit RSA key.
+	RSA3072 Algorithm = "rsa-3072"
+	// RSA4096 is a 4096 bit RSA key.
+	RSA4096 Algorithm = "rsa-4096"
+	// ECDSAP256 is an ECDSA key on the NIST P-256 curve.
+	ECDSAP256 Algorithm = "ecdsa-p256"
+	// Ed25519 is an Ed25519 key.
+	Ed25519 Algorithm = "ed25519"
+)
+
+// DefaultAlgorithm is the key algorithm to use when none is configured.
+const DefaultAlgorithm = RSA3072
+
+// Algorithms lists all the supported key algorithms.
+var Algorithms = []Algorithm{RSA3072, RSA4096, ECDSAP256, Ed25519}
+
+// RSA returns the Algorithm of an RSA key of the given size, e.g.
+// "rsa-2048".
+func RSA(bits int) Algorithm {
+	return Algorithm(fmt.Sprintf("rsa-%d", bits))
+}
+
+// RSABits returns the key size of an RSA algorithm, or 0 if the
+// algorithm is not RSA.
+func (a Algorithm) RSABits() int {
+	var bits int
+	if _, err := fmt.Sscanf(string(a), "rsa-%d", &bits); err != nil {
+		return 0
+	}
+
+	return bits
+}
+
+// ParseAlgorithm parses a key algorithm name. The empty string parses
+// to DefaultAlgorithm.
+func ParseAlgorithm(name string) (Algorithm, error) {
+	if name == "" {
+		return DefaultAlgorithm, nil
+	}
+
+	for _, a := range Algorithms {
+		if string(a) == name {
+			return a, nil
+		}
+	}
+
+	return "", fmt.Errorf("unsupported key algorithm %q", name)
+}
+
+// AlgorithmOf returns the Algorithm of the given SSH public key. RSA
+// keys of any size are accepted here, and it is up to the provider
+// Constraint whether the size is allowed.
+func AlgorithmOf(key ssh.PublicKey) (Algorithm, error) {
+	c, ok := key.(ssh.CryptoPublicKey)
+	if !ok {
+		return "", fmt.Errorf("unsupported key type %q", key.Type())
+	}
+
+	switch pub := c.CryptoPublicKey().(type) {
+	case *rsa.PublicKey:
+		return RSA(pub.N.BitLen()), nil
+	case *ecdsa.PublicKey:
+		if pub.Curve == elliptic.P256() {
+			return ECDSAP256, nil
+		}
+		return "", fmt.Errorf("unsupported ECDSA curve %s", pub.Curve.Params().Name)
+	case ed25519.PublicKey:
+		return Ed25519, nil
+	default:
+		return "", fmt.Errorf("unsupported key type %q", key.Type())
+	}
+}
+
+// Generate generates a new private key of the given algorithm.
+func Generate(alg Algorithm) (crypto.Signer, error) {
+	switch alg {
+	case RSA3072:
+		return rsa.GenerateKey(rand.Reader, 3072)
+	case RSA4096:
+		return rsa.GenerateKey(rand.Reader, 4096)
+	case ECDSAP256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case Ed25519:
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		return priv, err
+	default:
+		return nil, fmt.Errorf("unsupported key algorithm %q", alg)
+	}
+}
+
+// marshalPEM encodes the private key into a PEM block that OpenSSH
+// can load. RSA keys use PKCS#1, ECDSA keys use SEC 1 and Ed25519 keys
+// use the OpenSSH format, since OpenSSH may not load them from PKCS#8.
+func marshalPEM(key crypto.Signer) (*pem.Block, error) {
+	switch priv := key.(type) {
+	case *rsa.PrivateKey:
+		return &pem.Block{
+			Type:  "RSA PRIVATE KEY",
+			Bytes: x509.MarshalPKCS1PrivateKey(priv),
+		}, nil
+	case *ecdsa.PrivateKey:
+		b, err := x509.MarshalECPrivateKey(priv)
+		if err != nil {
+			return nil, err
+		}
+		return &pem.Block{Type: "EC PRIVATE KEY", Bytes: b}, nil
+	case ed25519.PrivateKey:
+		return ssh.MarshalPrivateKey(priv, "")
+	default:
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+}
+
+// MarshalPrivateKey encodes the private key to PEM. If passphrase is
+// not empty, the key is encoded in OpenSSH format, encrypted with a key
+// derived from the passphrase using bcrypt.
+func MarshalPrivateKey(key crypto.Signer, passphrase []byte) ([]byte, error) {
+	var b *pem.Block
+	var err error
+
+	if len(passphrase) > 0 {
+		b, err = ssh.MarshalPrivateKeyWithPassphrase(key, "", passphrase)
+	} else {
+		b, err = marshalPEM(key)
+	}
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	b := pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: x509.MarshalPKCS1PrivateKey(priv),
+	return pem.EncodeToMemory(b), nil
+}
+
+// ParsePrivateKey parses a PEM-encoded private key. The key may be of
+// any type that OpenSSH supports, in PKCS#1, SEC 1, PKCS#8 or OpenSSH
+// format. The passphrase is only used if the key is encrypted.
+func ParsePrivateKey(pemBytes []byte, passphrase []byte) (interface{}, error) {
+	priv, err := ssh.ParseRawPrivateKey(pemBytes)
+	if _, ok := err.(*ssh.PassphraseMissingError); ok {
+		if len(passphrase) == 0 {
+			return nil, errors.New("key is encrypted, but no passphrase was given")
+		}
+
+		priv, err = ssh.ParseRawPrivateKeyWithPassphrase(pemBytes, passphrase)
 	}
 
-	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0600)
+	return priv, err
+}
+
+// PublicKeyOf returns the SSH public key for the given private key.
+func PublicKeyOf(key interface{}) (ssh.PublicKey, error) {
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return signer.PublicKey(), nil
+}
+
+// MarshalAuthorizedKey returns the public key in authorized_keys
+// format, without the trailing newline.
+func MarshalAuthorizedKey(key ssh.PublicKey) string {
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+}
+
+// MarshalAuthorizedKeyWithComment returns the public key in
+// authorized_keys format, followed by the comment.
+func MarshalAuthorizedKeyWithComment(key ssh.PublicKey, comment string) string {
+	if comment == "" {
+		return MarshalAuthorizedKey(key)
+	}
+
+	return MarshalAuthorizedKey(key) + " " + comment
+}
+
+// ParsePublicKey parses a public key in authorized_keys format,
+// returning the key and its comment. For compatibility with keys stored
+// by older versions of the GCP stack, it also accepts the bare base64
+// encoding of the key.
+func ParsePublicKey(s string) (ssh.PublicKey, string, error) {
+	s = strings.TrimSpace(s)
+
+	if b, err := base64.StdEncoding.DecodeString(s); err == nil {
+		key, err := ssh.ParsePublicKey(b)
+		return key, "", err
+	}
+
+	key, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(s))
+	return key, comment, err
+}
+
+// GeneratePrivateKey generates a new private key of the given
+// algorithm, writing it to the file named by path.
+func GeneratePrivateKey(path string, alg Algorithm) error {
+	return GeneratePrivateKeyWithPassphrase(path, alg, nil)
+}
+
+// GeneratePrivateKeyWithPassphrase generates a new private key of the
+// given algorithm, writing it to the file named by path, encrypted with
+// the passphrase if it is not empty.
+func GeneratePrivateKeyWithPassphrase(path string, alg Algorithm, passphrase []byte) error {
+	priv, err := Generate(alg)
+	if err != nil {
+		return err
+	}
+
+	b, err := MarshalPrivateKey(priv, passphrase)
 	if err != nil {
 		return err
 	}
 
-	defer f.Close()
-	return pem.Encode(f, &b)
+	return ioutil.WriteFile(path, b, 0600)
 }
 
-// NewPublicKey attempts to read RSA private key from path, generating a
-// new key at that path if it doesn't exist. It returns the corresponding
-// SSH public key.
-func NewPublicKey(path string) (ssh.PublicKey, error) {
+// LoadPrivateKey attempts to read a private key from path, generating
+// a new key of the given algorithm at that path if it doesn't exist. The
+// key may be of any type that OpenSSH supports, in PKCS#1, SEC 1, PKCS#8
+// or OpenSSH format. The passphrase is only used if the key is
+// encrypted, or if a new key is generated.
+func LoadPrivateKey(path string, alg Algorithm, passphrase []byte) (interface{}, error) {
 	k, err := ioutil.ReadFile(path)
 	if os.IsNotExist(err) {
-		if err := GeneratePrivateKey(path); err != nil {
+		if err := GeneratePrivateKeyWithPassphrase(path, alg, passphrase); err != nil {
 			return nil, err
 		}
 
@@ -59,18 +257,84 @@ func NewPublicKey(path string) (ssh.PublicKey, error) {
 		return nil, err
 	}
 
-	b, _ := pem.Decode(k)
-	if b == nil {
-		return nil, fmt.Errorf("no PEM data in %q", path)
+	priv, err := ParsePrivateKey(k, passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %q: %w", path, err)
 	}
-	if b.Type != "RSA PRIVATE KEY" {
-		return nil, fmt.Errorf("wrong key type %q", b.Type)
+
+	return priv, nil
+}
+
+// EncryptFile encrypts the private key at path with the passphrase, if
+// the key is not already encrypted. The key is rewritten in OpenSSH
+// format. It returns whether the key was stored in plaintext.
+//
+// If dryRun is true, no files are changed.
+func EncryptFile(path string, passphrase []byte, dryRun bool) (bool, error) {
+	k, err := ioutil.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+
+	priv, err := ssh.ParseRawPrivateKey(k)
+	if _, ok := err.(*ssh.PassphraseMissingError); ok {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, fmt.Errorf("failed to parse %q: %w", path, err)
 	}
 
-	priv, err := x509.ParsePKCS1PrivateKey(b.Bytes)
+	if dryRun {
+		return true, nil
+	}
+
+	// OpenSSH format keys parse to a pointer, but only the value can
+	// be marshaled.
+	if p, ok := priv.(*ed25519.PrivateKey); ok {
+		priv = *p
+	}
+
+	b, err := ssh.MarshalPrivateKeyWithPassphrase(priv, "", passphrase)
+	if err != nil {
+		return true, err
+	}
+
+	// Replace the file in one step, so that the key isn't lost if
+	// writing fails part way.
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, pem.EncodeToMemory(b), 0600); err != nil {
+		return true, err
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return true, err
+	}
+
+	return true, nil
+}
+
+// NewPublicKey attempts to read a private key from path, generating a
+// new key of the given algorithm at that path if it doesn't exist. It
+// returns the corresponding SSH public key.
+func NewPublicKey(path string, alg Algorithm) (ssh.PublicKey, error) {
+	return NewPublicKeyWithPassphrase(path, alg, nil)
+}
+
+// NewPublicKeyWithPassphrase is like NewPublicKey, but can read and
+// generate keys that are encrypted with a passphrase.
+func NewPublicKeyWithPassphrase(path string, alg Algorithm, passphrase []byte) (ssh.PublicKey, error) {
+	priv, err := LoadPrivateKey(path, alg, passphrase)
 	if err != nil {
 		return nil, err
 	}
 
-	return ssh.NewPublicKey(&priv.PublicKey)
+	return PublicKeyOf(priv)
+}
+
+// WritePublicKey writes the public key to the file named by path, in
+// authorized_keys format.
+func WritePublicKey(path string, key ssh.PublicKey) error {
+	return ioutil.WriteFile(path, ssh.MarshalAuthorizedKey(key), 0644)
 }
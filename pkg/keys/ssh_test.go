@@ -0,0 +1,61 @@
+package keys
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestEncryptFile(t *testing.T) {
+	passphrase := []byte("correct horse")
+
+	for _, alg := range []Algorithm{Ed25519, ECDSAP256} {
+		path := filepath.Join(t.TempDir(), "identity.pem")
+		if err := GeneratePrivateKey(path, alg); err != nil {
+			t.Fatal(err)
+		}
+
+		want, err := NewPublicKey(path, alg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		before, _ := ioutil.ReadFile(path)
+
+		// A dry run reports the plaintext key, but leaves it alone.
+		plaintext, err := EncryptFile(path, passphrase, true)
+		if err != nil || !plaintext {
+			t.Fatalf("%s: dry run got %t, %v, want plaintext", alg, plaintext, err)
+		}
+
+		if after, _ := ioutil.ReadFile(path); !bytes.Equal(before, after) {
+			t.Fatalf("%s: dry run changed the key", alg)
+		}
+
+		plaintext, err = EncryptFile(path, passphrase, false)
+		if err != nil || !plaintext {
+			t.Fatalf("%s: got %t, %v, want plaintext", alg, plaintext, err)
+		}
+
+		if _, err := LoadPrivateKey(path, alg, nil); err == nil {
+			t.Fatalf("%s: key loads without the passphrase", alg)
+		}
+
+		priv, err := LoadPrivateKey(path, alg, passphrase)
+		if err != nil {
+			t.Fatalf("%s: %s", alg, err)
+		}
+
+		got, err := PublicKeyOf(priv)
+		if err != nil || !bytes.Equal(got.Marshal(), want.Marshal()) {
+			t.Fatalf("%s: encrypting changed the key", alg)
+		}
+
+		// An encrypted key is left alone.
+		plaintext, err = EncryptFile(path, passphrase, false)
+		if err != nil || plaintext {
+			t.Errorf("%s: encrypting again got %t, %v", alg, plaintext, err)
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package probe
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Target is a host to probe.
+type Target struct {
+	// Name is the host name for status reports.
+	Name string
+	// Address is the host address. The port defaults to 22.
+	Address string
+	// User is the login user.
+	User string
+	// HostKey is the expected host key. If it is nil, any host key
+	// is accepted.
+	HostKey ssh.PublicKey
+}
+
+// Options configures the probes.
+type Options struct {
+	// Signers are the identities to authenticate with.
+	Signers []ssh.Signer
+	// Timeout is how long to keep trying to reach all the hosts.
+	Timeout time.Duration
+	// DialTimeout is how long each attempt can take.
+	DialTimeout time.Duration
+	// Backoff is the delay before the first retry. The delay doubles
+	// after each attempt, up to MaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// DefaultOptions returns the default options for signers.
+func DefaultOptions(signers ...ssh.Signer) Options {
+	return Options{
+		Signers:     signers,
+		Timeout:     5 * time.Minute,
+		DialTimeout: 10 * time.Second,
+		Backoff:     time.Second,
+		MaxBackoff:  15 * time.Second,
+	}
+}
+
+// Status is the result of probing a host.
+type Status struct {
+	Name     string
+	Ready    bool
+	Attempts int
+	Elapsed  time.Duration
+	// Err is the error from the last attempt.
+	Err error
+}
+
+func (s Status) String() string {
+	if s.Ready {
+		return fmt.Sprintf("%s: ready after %s (%d attempts)", s.Name, s.Elapsed.Round(time.Second), s.Attempts)
+	}
+
+	return fmt.Sprintf("%s: not ready after %s (%d attempts): %s", s.Name, s.Elapsed.Round(time.Second), s.Attempts, s.Err)
+}
+
+// Failed returns the statuses of the hosts that are not ready.
+func Failed(statuses []Status) []Status {
+	var failed []Status
+	for _, s := range statuses {
+		if !s.Ready {
+			failed = append(failed, s)
+		}
+	}
+
+	return failed
+}
+
+func withPort(address string) string {
+	if _, _, err := net.SplitHostPort(address); err == nil {
+		return address
+	}
+
+	return net.JoinHostPort(address, "22")
+}
+
+func (o Options) clientConfig(t Target) *ssh.ClientConfig {
+	config := &ssh.ClientConfig{
+		User:            t.User,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(o.Signers...)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+
+	// The host may have other types of host keys as well as the pinned
+	// key, so only ask for the pinned type. Otherwise the server may
+	// offer a key of a type that x/crypto prefers, which never matches.
+	if t.HostKey != nil {
+		config.HostKeyCallback = ssh.FixedHostKey(t.HostKey)
+		config.HostKeyAlgorithms = []string{t.HostKey.Type()}
+	}
+
+	return config
+}
+
+// retry calls attempt until it succeeds or ctx is done, backing off
+// between attempts.
+func (o Options) retry(ctx context.Context, name string, attempt func() error) Status {
+	start := time.Now()
+	status := Status{Name: name}
+	delay := o.Backoff
+
+	for {
+		status.Attempts++
+		status.Err = attempt()
+		status.Elapsed = time.Since(start)
+
+		if status.Err == nil {
+			status.Ready = true
+			return status
+		}
+
+		select {
+		case <-ctx.Done():
+			return status
+		case <-time.After(delay):
+		}
+
+		if delay *= 2; delay > o.MaxBackoff {
+			delay = o.MaxBackoff
+		}
+	}
+}
+
+// Dial connects to the target, retrying until it succeeds or ctx is
+// done. On success, the caller must close the client.
+func Dial(ctx context.Context, t Target, opts Options) (*ssh.Client, Status) {
+	var client *ssh.Client
+
+	status := opts.retry(ctx, t.Name, func() error {
+		var err error
+		client, err = dial(t, opts)
+		return err
+	})
+
+	return client, status
+}
+
+// dial opens a SSH connection to the target.
+func dial(t Target, opts Options) (*ssh.Client, error) {
+	address := withPort(t.Address)
+
+	conn, err := net.DialTimeout("tcp", address, opts.DialTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	// The client config timeout only bounds the TCP connection, and a
+	// booting host can accept connections before SSH answers, so bound
+	// the handshake too.
+	if err := conn.SetDeadline(time.Now().Add(opts.DialTimeout)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	c, chans, reqs, err := ssh.NewClientConn(conn, address, opts.clientConfig(t))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// dialVia opens a SSH connection to the target through client.
+func dialVia(client *ssh.Client, t Target, opts Options) error {
+	address := withPort(t.Address)
+
+	conn, err := client.Dial("tcp", address)
+	if err != nil {
+		return err
+	}
+
+	// Connections through the bastion don't support deadlines, so
+	// bound the handshake by closing the connection.
+	timer := time.AfterFunc(opts.DialTimeout, func() { conn.Close() })
+	defer timer.Stop()
+
+	c, chans, reqs, err := ssh.NewClientConn(conn, address, opts.clientConfig(t))
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	return ssh.NewClient(c, chans, reqs).Close()
+}
+
+// Wait waits until SSH works on each of the targets, by connecting to
+// the bastion and then to each target through the bastion. If bastion
+// is nil, the targets are dialed directly. It returns the status of the
+// bastion (if any), followed by the status of each target.
+func Wait(ctx context.Context, bastion *Target, targets []Target, opts Options) []Status {
+	ctx, cancel := context.WithTimeout(ctx, opts.Timeout)
+	defer cancel()
+
+	var statuses []Status
+	var client *ssh.Client
+
+	if bastion != nil {
+		var status Status
+
+		client, status = Dial(ctx, *bastion, opts)
+		statuses = append(statuses, status)
+
+		if !status.Ready {
+			for _, t := range targets {
+				statuses = append(statuses, Status{
+					Name: t.Name,
+					Err:  fmt.Errorf("%s is not ready", bastion.Name),
+				})
+			}
+
+			return statuses
+		}
+
+		defer client.Close()
+	}
+
+	results := make([]Status, len(targets))
+
+	var wg sync.WaitGroup
+	for i, t := range targets {
+		wg.Add(1)
+		go func(i int, t Target) {
+			defer wg.Done()
+
+			if client == nil {
+				c, status := Dial(ctx, t, opts)
+				if c != nil {
+					c.Close()
+				}
+
+				results[i] = status
+				return
+			}
+
+			results[i] = opts.retry(ctx, t.Name, func() error {
+				return dialVia(client, t, opts)
+			})
+		}(i, t)
+	}
+
+	wg.Wait()
+
+	return append(statuses, results...)
+}
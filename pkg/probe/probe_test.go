@@ -0,0 +1,281 @@
+package probe
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// testSigner returns a fixed Ed25519 signer.
+func testSigner(t *testing.T, seed byte) ssh.Signer {
+	t.Helper()
+
+	s, err := ssh.NewSignerFromKey(ed25519.NewKeyFromSeed(bytes.Repeat([]byte{seed}, ed25519.SeedSize)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+// testOptions returns options with short timeouts.
+func testOptions(signers ...ssh.Signer) Options {
+	return Options{
+		Signers:     signers,
+		Timeout:     500 * time.Millisecond,
+		DialTimeout: 100 * time.Millisecond,
+		Backoff:     10 * time.Millisecond,
+		MaxBackoff:  40 * time.Millisecond,
+	}
+}
+
+// listen returns the address of a listener that passes each connection
+// to serve, until the test ends.
+func listen(t *testing.T, serve func(net.Conn)) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go serve(conn)
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+// newServer starts a SSH server with the host key that lets the user
+// with the authorized key in. Like the bastion, it forwards TCP
+// connections.
+func newServer(t *testing.T, hostKey ssh.Signer, authorized ssh.PublicKey) string {
+	t.Helper()
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(_ ssh.ConnMetadata, k ssh.PublicKey) (*ssh.Permissions, error) {
+			if bytes.Equal(k.Marshal(), authorized.Marshal()) {
+				return nil, nil
+			}
+
+			return nil, fmt.Errorf("unauthorized key")
+		},
+	}
+
+	config.AddHostKey(hostKey)
+
+	return listen(t, func(conn net.Conn) {
+		defer conn.Close()
+
+		_, chans, reqs, err := ssh.NewServerConn(conn, config)
+		if err != nil {
+			return
+		}
+
+		go ssh.DiscardRequests(reqs)
+
+		for c := range chans {
+			if c.ChannelType() != "direct-tcpip" {
+				c.Reject(ssh.UnknownChannelType, c.ChannelType())
+				continue
+			}
+
+			var target struct {
+				Host       string
+				Port       uint32
+				OriginHost string
+				OriginPort uint32
+			}
+
+			if err := ssh.Unmarshal(c.ExtraData(), &target); err != nil {
+				c.Reject(ssh.ConnectionFailed, err.Error())
+				continue
+			}
+
+			forward, err := net.Dial("tcp", net.JoinHostPort(target.Host, strconv.Itoa(int(target.Port))))
+			if err != nil {
+				c.Reject(ssh.ConnectionFailed, err.Error())
+				continue
+			}
+
+			ch, chReqs, err := c.Accept()
+			if err != nil {
+				forward.Close()
+				continue
+			}
+
+			go ssh.DiscardRequests(chReqs)
+			go func() {
+				io.Copy(ch, forward)
+				ch.Close()
+			}()
+			go func() {
+				io.Copy(forward, ch)
+				forward.Close()
+			}()
+		}
+	})
+}
+
+// newSilentServer starts a server that accepts connections but never
+// answers, like a host that is still booting.
+func newSilentServer(t *testing.T) string {
+	t.Helper()
+
+	done := make(chan struct{})
+	t.Cleanup(func() { close(done) })
+
+	return listen(t, func(conn net.Conn) {
+		defer conn.Close()
+		<-done
+	})
+}
+
+func TestDial(t *testing.T) {
+	hostKey := testSigner(t, 1)
+	otherKey := testSigner(t, 2)
+	user := testSigner(t, 3)
+
+	addr := newServer(t, hostKey, user.PublicKey())
+
+	tests := []struct {
+		name    string
+		hostKey ssh.PublicKey
+		signer  ssh.Signer
+		err     string
+	}{
+		{"any host key", nil, user, ""},
+		{"pinned host key", hostKey.PublicKey(), user, ""},
+		{"other host key", otherKey.PublicKey(), user, "host key mismatch"},
+		{"unauthorized", hostKey.PublicKey(), otherKey, "unable to authenticate"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := testOptions(tt.signer)
+
+			ctx, cancel := context.WithTimeout(context.Background(), opts.Timeout)
+			defer cancel()
+
+			client, status := Dial(ctx, Target{Name: "bastion", Address: addr, User: "fedora", HostKey: tt.hostKey}, opts)
+			if client != nil {
+				client.Close()
+			}
+
+			if tt.err == "" {
+				if !status.Ready || status.Attempts != 1 || status.Err != nil {
+					t.Fatalf("got %s", status)
+				}
+
+				return
+			}
+
+			// The attempts are retried until the timeout.
+			if status.Ready || status.Attempts < 2 || status.Err == nil || !strings.Contains(status.Err.Error(), tt.err) {
+				t.Fatalf("got %s, want %q", status, tt.err)
+			}
+		})
+	}
+}
+
+func TestDialTimeout(t *testing.T) {
+	opts := testOptions(testSigner(t, 3))
+
+	ctx, cancel := context.WithTimeout(context.Background(), opts.Timeout)
+	defer cancel()
+
+	// Each attempt takes the dial timeout, and the delays between the
+	// attempts are 10, 20, 40 and then 40ms, so 3 or 4 attempts fit
+	// before the timeout.
+	client, status := Dial(ctx, Target{Name: "workload-0", Address: newSilentServer(t), User: "fedora"}, opts)
+	if client != nil {
+		client.Close()
+		t.Fatalf("connected to a silent server")
+	}
+
+	if status.Ready || status.Attempts < 3 || status.Err == nil {
+		t.Errorf("got %s", status)
+	}
+
+	if status.Elapsed > opts.Timeout+2*opts.DialTimeout {
+		t.Errorf("gave up after %s, want about %s", status.Elapsed, opts.Timeout)
+	}
+
+	if !strings.Contains(status.String(), "workload-0: not ready after") {
+		t.Errorf("got %q", status.String())
+	}
+}
+
+func TestWait(t *testing.T) {
+	hostKey := testSigner(t, 1)
+	user := testSigner(t, 3)
+
+	bastion := Target{Name: "bastion", Address: newServer(t, hostKey, user.PublicKey()), User: "fedora", HostKey: hostKey.PublicKey()}
+	targets := []Target{
+		{Name: "workload-0", Address: newServer(t, hostKey, user.PublicKey()), User: "fedora", HostKey: hostKey.PublicKey()},
+		{Name: "workload-1", Address: newSilentServer(t), User: "fedora"},
+	}
+
+	names := func(statuses []Status) []string {
+		var n []string
+		for _, s := range statuses {
+			n = append(n, s.Name)
+		}
+
+		return n
+	}
+
+	// Through the bastion.
+	statuses := Wait(context.Background(), &bastion, targets, testOptions(user))
+	if got := strings.Join(names(statuses), " "); got != "bastion workload-0 workload-1" {
+		t.Fatalf("got statuses for %s", got)
+	}
+
+	if !statuses[0].Ready || !statuses[1].Ready || statuses[2].Ready {
+		t.Errorf("got %s", statuses)
+	}
+
+	if failed := Failed(statuses); len(failed) != 1 || failed[0].Name != "workload-1" {
+		t.Errorf("got failed %s", failed)
+	}
+
+	// Directly.
+	statuses = Wait(context.Background(), nil, targets, testOptions(user))
+	if got := strings.Join(names(statuses), " "); got != "workload-0 workload-1" {
+		t.Fatalf("got statuses for %s", got)
+	}
+
+	if !statuses[0].Ready || statuses[1].Ready {
+		t.Errorf("got %s", statuses)
+	}
+
+	// The targets aren't tried without the bastion.
+	bastion.Address = newSilentServer(t)
+
+	statuses = Wait(context.Background(), &bastion, targets[:1], testOptions(user))
+	if len(statuses) != 2 || statuses[0].Ready || statuses[1].Ready || statuses[1].Attempts != 0 {
+		t.Fatalf("got %s", statuses)
+	}
+
+	if !strings.Contains(statuses[1].Err.Error(), "bastion is not ready") {
+		t.Errorf("got %s", statuses[1].Err)
+	}
+}
@@ -0,0 +1,69 @@
+package remote
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/jpeach/pulumi-stacks/pkg/conf"
+)
+
+// authorizedKeysScript drops the block between the b and e fences, and
+// any other line that holds one of the blobs in keys. A b fence without
+// a matching e fence is left alone, along with the lines after it.
+const authorizedKeysScript = `
+BEGIN { n = split(keys, k, " "); for (i = 1; i <= n; i++) stack[k[i]] = 1 }
+function ours(l,    f, i, n) {
+	n = split(l, f, " ")
+	for (i = 1; i <= n; i++) if (f[i] in stack) return 1
+	return 0
+}
+$0 == b && !held { held = 1; nheld = 0; next }
+held && $0 == e { held = 0; next }
+held { lines[++nheld] = $0; next }
+!ours($0) { print }
+END {
+	if (!held) exit
+	print b
+	for (i = 1; i <= nheld; i++) if (!ours(lines[i])) print lines[i]
+}
+`
+
+// AuthorizedKeysCommand returns a shell command that installs keys in
+// ~/.ssh/authorized_keys on a host. The keys go in a block at the top of
+// the file, fenced by comments naming the stack, that replaces the block
+// from the last run, so keys that are no longer listed are removed.
+// Other lines that hold one of the keys, such as the key that the cloud
+// provider installs when the instance launches, move into the block.
+func AuthorizedKeysCommand(name string, keys []ssh.PublicKey) string {
+	begin, end := "# BEGIN pulumi-stacks "+name, "# END pulumi-stacks "+name
+
+	block := []string{conf.ShellQuote(begin)}
+	var blobs []string
+
+	for _, k := range keys {
+		line := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(k)))
+		block = append(block, conf.ShellQuote(line+" "+name))
+		blobs = append(blobs, base64.StdEncoding.EncodeToString(k.Marshal()))
+	}
+
+	block = append(block, conf.ShellQuote(end))
+
+	return strings.Join([]string{
+		"set -e",
+		`mkdir -p -m 700 "$HOME/.ssh"`,
+		`f="$HOME/.ssh/authorized_keys"`,
+		`touch "$f"`,
+		`tmp=$(mktemp "$f.XXXXXX")`,
+		`trap 'rm -f "$tmp"' EXIT`,
+		"{",
+		fmt.Sprintf("  printf '%%s\\n' %s", strings.Join(block, " ")),
+		fmt.Sprintf("  awk -v b=%s -v e=%s -v keys=%s %s \"$f\"",
+			conf.ShellQuote(begin), conf.ShellQuote(end),
+			conf.ShellQuote(strings.Join(blobs, " ")), conf.ShellQuote(authorizedKeysScript)),
+		`} > "$tmp"`,
+		`mv -f "$tmp" "$f"`,
+	}, "\n")
+}
@@ -0,0 +1,131 @@
+package remote
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// testKey returns a fixed Ed25519 public key, and its authorized_keys
+// line without a comment.
+func testKey(t *testing.T, seed byte) (ssh.PublicKey, string) {
+	t.Helper()
+
+	priv := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{seed}, ed25519.SeedSize))
+
+	pub, err := ssh.NewPublicKey(priv.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pub, strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pub)))
+}
+
+// runAuthorizedKeys runs the command with its home directory at home,
+// and returns the resulting authorized_keys file.
+func runAuthorizedKeys(t *testing.T, home string, keys ...ssh.PublicKey) string {
+	t.Helper()
+
+	cmd := exec.Command("sh", "-c", AuthorizedKeysCommand("aws-devel/dev", keys))
+	cmd.Env = []string{"HOME=" + home, "PATH=/usr/bin:/bin"}
+
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("%s: %s", err, out)
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(home, ".ssh", "authorized_keys"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(b)
+}
+
+func TestAuthorizedKeysCommand(t *testing.T) {
+	oldKey, oldLine := testKey(t, 1)
+	newKey, newLine := testKey(t, 2)
+	_, otherLine := testKey(t, 3)
+
+	home := t.TempDir()
+
+	// The .ssh directory doesn't exist yet.
+	got := runAuthorizedKeys(t, home, oldKey)
+	want := "# BEGIN pulumi-stacks aws-devel/dev\n" +
+		oldLine + " aws-devel/dev\n" +
+		"# END pulumi-stacks aws-devel/dev\n"
+
+	if got != want {
+		t.Fatalf("got\n%s\nwant\n%s", got, want)
+	}
+
+	// The launch key moves into the block, and other keys stay.
+	path := filepath.Join(home, ".ssh", "authorized_keys")
+	if err := ioutil.WriteFile(path, []byte(oldLine+" launch\n"+otherLine+" alice\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// During a rotation, both keys are installed.
+	got = runAuthorizedKeys(t, home, newKey, oldKey)
+	want = "# BEGIN pulumi-stacks aws-devel/dev\n" +
+		newLine + " aws-devel/dev\n" +
+		oldLine + " aws-devel/dev\n" +
+		"# END pulumi-stacks aws-devel/dev\n" +
+		otherLine + " alice\n"
+
+	if got != want {
+		t.Fatalf("got\n%s\nwant\n%s", got, want)
+	}
+
+	// Running again changes nothing.
+	if again := runAuthorizedKeys(t, home, newKey, oldKey); again != got {
+		t.Fatalf("second run got\n%s\nwant\n%s", again, got)
+	}
+
+	// Retiring the old key removes it.
+	got = runAuthorizedKeys(t, home, newKey)
+	want = "# BEGIN pulumi-stacks aws-devel/dev\n" +
+		newLine + " aws-devel/dev\n" +
+		"# END pulumi-stacks aws-devel/dev\n" +
+		otherLine + " alice\n"
+
+	if got != want {
+		t.Fatalf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestAuthorizedKeysCommandUnmatchedFence(t *testing.T) {
+	key, line := testKey(t, 1)
+	_, otherLine := testKey(t, 3)
+
+	home := t.TempDir()
+	path := filepath.Join(home, ".ssh", "authorized_keys")
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	// The END fence was removed by hand, so the lines after the BEGIN
+	// fence belong to the user.
+	edited := "# BEGIN pulumi-stacks aws-devel/dev\n" + otherLine + " alice\n"
+	if err := ioutil.WriteFile(path, []byte(edited), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "# BEGIN pulumi-stacks aws-devel/dev\n" +
+		line + " aws-devel/dev\n" +
+		"# END pulumi-stacks aws-devel/dev\n" +
+		edited
+
+	for i := 0; i < 2; i++ {
+		if got := runAuthorizedKeys(t, home, key); got != want {
+			t.Fatalf("run %d got\n%s\nwant\n%s", i, got, want)
+		}
+	}
+}
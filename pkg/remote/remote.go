@@ -0,0 +1,158 @@
+package remote
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jpeach/pulumi-stacks/pkg/conf"
+)
+
+// Step is a provisioning step that runs on hosts over SSH. A step
+// either runs a script file, runs an inline command, or copies a file.
+type Step struct {
+	// Name identifies the step.
+	Name string `json:"name"`
+	// Hosts are the names or groups of the hosts to run the step on.
+	Hosts []string `json:"hosts,omitempty"`
+	// Script is the path of a shell script to run.
+	Script string `json:"script,omitempty"`
+	// Command is a shell command to run.
+	Command string `json:"command,omitempty"`
+	// Source is the path of a file to copy to Destination on the host.
+	Source      string `json:"source,omitempty"`
+	Destination string `json:"destination,omitempty"`
+	// Sudo is true if the script or command runs as root.
+	Sudo bool `json:"sudo,omitempty"`
+}
+
+// Validate checks that the step is complete.
+func (s *Step) Validate() error {
+	if s.Name == "" {
+		return fmt.Errorf("step name is required")
+	}
+
+	n := 0
+	for _, v := range []string{s.Script, s.Command, s.Source} {
+		if v != "" {
+			n++
+		}
+	}
+
+	if n != 1 {
+		return fmt.Errorf("step %q: exactly one of script, command or source is required", s.Name)
+	}
+
+	if s.Source != "" && s.Destination == "" {
+		return fmt.Errorf("step %q: destination is required to copy %q", s.Name, s.Source)
+	}
+
+	return nil
+}
+
+// Matches returns whether the step runs on the host with the given name
+// and groups.
+func (s *Step) Matches(name string, groups []string) bool {
+	for _, h := range s.Hosts {
+		if h == name {
+			return true
+		}
+
+		for _, g := range groups {
+			if h == g {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Invocation is the local command that performs a step on a host.
+type Invocation struct {
+	// Command is the shell command to run.
+	Command string
+	// Stdin is the input for the command.
+	Stdin string
+	// Digest changes when the step or its files change.
+	Digest string
+}
+
+// Invocation returns the command that performs the step on the host
+// with the given alias in the SSH client configuration file at
+// configPath.
+func (s *Step) Invocation(configPath string, alias string) (*Invocation, error) {
+	ssh := fmt.Sprintf("ssh -F %s -o BatchMode=yes %s", conf.ShellQuote(configPath), conf.ShellQuote(alias))
+
+	sh := "sh -s"
+	if s.Sudo {
+		sh = "sudo sh -s"
+	}
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%t\x00", s.Name, s.Destination, s.Sudo)
+
+	switch {
+	case s.Script != "":
+		b, err := ioutil.ReadFile(s.Script)
+		if err != nil {
+			return nil, fmt.Errorf("step %q: %w", s.Name, err)
+		}
+
+		h.Write(b)
+		return &Invocation{
+			Command: fmt.Sprintf("%s %s", ssh, sh),
+			Stdin:   string(b),
+			Digest:  hex.EncodeToString(h.Sum(nil)),
+		}, nil
+
+	case s.Command != "":
+		h.Write([]byte(s.Command))
+		return &Invocation{
+			Command: fmt.Sprintf("%s %s", ssh, sh),
+			Stdin:   s.Command + "\n",
+			Digest:  hex.EncodeToString(h.Sum(nil)),
+		}, nil
+
+	default:
+		source, err := filepath.Abs(s.Source)
+		if err != nil {
+			return nil, err
+		}
+
+		b, err := ioutil.ReadFile(source)
+		if err != nil {
+			return nil, fmt.Errorf("step %q: %w", s.Name, err)
+		}
+
+		h.Write(b)
+		return &Invocation{
+			Command: fmt.Sprintf("scp -F %s -o BatchMode=yes %s %s",
+				conf.ShellQuote(configPath), conf.ShellQuote(source), conf.ShellQuote(alias+":"+s.Destination)),
+			Digest: hex.EncodeToString(h.Sum(nil)),
+		}, nil
+	}
+}
+
+// WaitCommand returns a shell command that waits until SSH works on the
+// host with the given alias, or fails after timeout. Instances take a
+// while to start SSH after they are created.
+func WaitCommand(configPath string, alias string, timeout time.Duration) string {
+	tries := int(timeout / (10 * time.Second))
+	if tries < 1 {
+		tries = 1
+	}
+
+	return strings.Join([]string{
+		"n=0",
+		fmt.Sprintf("until ssh -F %s -o BatchMode=yes -o ConnectTimeout=10 %s true; do",
+			conf.ShellQuote(configPath), conf.ShellQuote(alias)),
+		fmt.Sprintf(`  n=$((n + 1)); test $n -ge %d && exit 1`, tries),
+		"  sleep 10",
+		"done",
+	}, "\n")
+}
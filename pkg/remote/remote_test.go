@@ -0,0 +1,240 @@
+package remote
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// configPath is an SSH config path that needs quoting.
+const configPath = "/home/me/it's a stack/ssh config"
+
+// fakeBin returns a directory with ssh and scp commands that print
+// their arguments, one per line, and exit with the given status.
+func fakeBin(t *testing.T, status int) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	script := fmt.Sprintf("#!/bin/sh\nfor a in \"$@\"; do printf '%%s\\n' \"$a\"; done\nexit %d\n", status)
+
+	for _, name := range []string{"ssh", "scp"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return dir
+}
+
+// run runs the shell command with the fake ssh and scp commands, and
+// returns its output.
+func run(t *testing.T, bin string, command string) (string, error) {
+	t.Helper()
+
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Env = []string{"PATH=" + bin + ":/usr/bin:/bin"}
+
+	out, err := cmd.CombinedOutput()
+	return string(out), err
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		step Step
+		err  string
+	}{
+		{Step{Name: "a", Command: "true"}, ""},
+		{Step{Name: "a", Script: "a.sh"}, ""},
+		{Step{Name: "a", Source: "a.conf", Destination: "/etc/a.conf"}, ""},
+		{Step{Command: "true"}, "step name is required"},
+		{Step{Name: "a"}, "exactly one of"},
+		{Step{Name: "a", Command: "true", Script: "a.sh"}, "exactly one of"},
+		{Step{Name: "a", Source: "a.conf"}, "destination is required"},
+	}
+
+	for _, tt := range tests {
+		err := tt.step.Validate()
+
+		if tt.err == "" {
+			if err != nil {
+				t.Errorf("%+v: %v", tt.step, err)
+			}
+
+			continue
+		}
+
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%+v: got %v, want error %q", tt.step, err, tt.err)
+		}
+	}
+}
+
+func TestMatches(t *testing.T) {
+	s := Step{Name: "a", Hosts: []string{"bastion", "gpu"}}
+
+	tests := []struct {
+		name   string
+		groups []string
+		want   bool
+	}{
+		{"bastion", nil, true},
+		{"workload-1", []string{"workload", "gpu"}, true},
+		{"workload-0", []string{"workload", "cpu"}, false},
+		{"gpu", nil, true},
+	}
+
+	for _, tt := range tests {
+		if got := s.Matches(tt.name, tt.groups); got != tt.want {
+			t.Errorf("%s %q: got %t, want %t", tt.name, tt.groups, got, tt.want)
+		}
+	}
+
+	if (&Step{Name: "none"}).Matches("bastion", []string{"bastion"}) {
+		t.Errorf("a step without hosts matched")
+	}
+}
+
+func TestInvocation(t *testing.T) {
+	dir := t.TempDir()
+	bin := fakeBin(t, 0)
+
+	script := filepath.Join(dir, "setup.sh")
+	source := filepath.Join(dir, "my file.conf")
+
+	write := func(path string, content string) {
+		t.Helper()
+
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(script, "echo one\n")
+	write(source, "one\n")
+
+	invoke := func(s Step) *Invocation {
+		t.Helper()
+
+		i, err := s.Invocation(configPath, "workload-0")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return i
+	}
+
+	// The arguments survive the shell, whatever the quoting.
+	command := invoke(Step{Name: "a", Command: "uname -a"})
+	if out, err := run(t, bin, command.Command); err != nil || out != "-F\n"+configPath+"\n-o\nBatchMode=yes\nworkload-0\nsh\n-s\n" {
+		t.Errorf("ran %q: got %q, %v", command.Command, out, err)
+	}
+
+	if command.Stdin != "uname -a\n" {
+		t.Errorf("got stdin %q", command.Stdin)
+	}
+
+	// Root steps wrap the shell in sudo.
+	sudo := invoke(Step{Name: "a", Command: "uname -a", Sudo: true})
+	if out, err := run(t, bin, sudo.Command); err != nil || !strings.HasSuffix(out, "workload-0\nsudo\nsh\n-s\n") {
+		t.Errorf("ran %q: got %q, %v", sudo.Command, out, err)
+	}
+
+	if sudo.Digest == command.Digest {
+		t.Errorf("the digest didn't change with sudo")
+	}
+
+	copied := invoke(Step{Name: "b", Source: source, Destination: "/etc/my file.conf"})
+	if out, err := run(t, bin, copied.Command); err != nil || out != "-F\n"+configPath+"\n-o\nBatchMode=yes\n"+source+"\nworkload-0:/etc/my file.conf\n" {
+		t.Errorf("ran %q: got %q, %v", copied.Command, out, err)
+	}
+
+	if copied.Stdin != "" {
+		t.Errorf("got stdin %q for a copy", copied.Stdin)
+	}
+
+	ran := invoke(Step{Name: "c", Script: script})
+	if ran.Stdin != "echo one\n" {
+		t.Errorf("got stdin %q", ran.Stdin)
+	}
+
+	// The digests are stable until the step or its files change.
+	if again := invoke(Step{Name: "a", Command: "uname -a"}); again.Digest != command.Digest {
+		t.Errorf("the command digest changed from %s to %s", command.Digest, again.Digest)
+	}
+
+	if again := invoke(Step{Name: "b", Source: source, Destination: "/etc/my file.conf"}); again.Digest != copied.Digest {
+		t.Errorf("the copy digest changed from %s to %s", copied.Digest, again.Digest)
+	}
+
+	if again := invoke(Step{Name: "c", Script: script}); again.Digest != ran.Digest {
+		t.Errorf("the script digest changed from %s to %s", ran.Digest, again.Digest)
+	}
+
+	// The digest doesn't depend on the host.
+	if other, _ := (&Step{Name: "a", Command: "uname -a"}).Invocation(configPath, "bastion"); other.Digest != command.Digest {
+		t.Errorf("the digest changed with the host")
+	}
+
+	if changed := invoke(Step{Name: "a", Command: "uname -r"}); changed.Digest == command.Digest {
+		t.Errorf("the digest didn't change with the command")
+	}
+
+	if changed := invoke(Step{Name: "b", Source: source, Destination: "/etc/other.conf"}); changed.Digest == copied.Digest {
+		t.Errorf("the digest didn't change with the destination")
+	}
+
+	write(script, "echo two\n")
+	write(source, "two\n")
+
+	if changed := invoke(Step{Name: "c", Script: script}); changed.Digest == ran.Digest || changed.Stdin != "echo two\n" {
+		t.Errorf("the digest didn't change with the script")
+	}
+
+	if changed := invoke(Step{Name: "b", Source: source, Destination: "/etc/my file.conf"}); changed.Digest == copied.Digest {
+		t.Errorf("the digest didn't change with the source file")
+	}
+
+	// Missing files are errors.
+	if err := os.Remove(script); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := (&Step{Name: "c", Script: script}).Invocation(configPath, "workload-0"); err == nil || !strings.Contains(err.Error(), `step "c"`) {
+		t.Errorf("got %v, want an error for the missing script", err)
+	}
+}
+
+func TestWaitCommand(t *testing.T) {
+	tests := []struct {
+		timeout time.Duration
+		tries   string
+	}{
+		{5 * time.Minute, "test $n -ge 30 "},
+		{time.Minute, "test $n -ge 6 "},
+		{15 * time.Second, "test $n -ge 1 "},
+		{0, "test $n -ge 1 "},
+	}
+
+	for _, tt := range tests {
+		if got := WaitCommand(configPath, "bastion", tt.timeout); !strings.Contains(got, tt.tries) {
+			t.Errorf("%s: got %q, want %q", tt.timeout, got, tt.tries)
+		}
+	}
+
+	// SSH works, so the command succeeds straight away.
+	out, err := run(t, fakeBin(t, 0), WaitCommand(configPath, "bastion", time.Second))
+	if err != nil || out != "-F\n"+configPath+"\n-o\nBatchMode=yes\n-o\nConnectTimeout=10\nbastion\ntrue\n" {
+		t.Errorf("got %q, %v", out, err)
+	}
+
+	// SSH fails, and a single try is allowed, so the command fails
+	// without waiting.
+	if _, err := run(t, fakeBin(t, 255), WaitCommand(configPath, "bastion", time.Second)); err == nil {
+		t.Errorf("waited for a host that never answered")
+	}
+}
@@ -0,0 +1,152 @@
+package wireguard
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+// Key is a WireGuard private or public key.
+type Key [curve25519.ScalarSize]byte
+
+// GenerateKey generates a new private key.
+func GenerateKey() (Key, error) {
+	var k Key
+	if _, err := rand.Read(k[:]); err != nil {
+		return Key{}, err
+	}
+
+	// Clamp the key, as "wg genkey" does.
+	k[0] &= 248
+	k[31] = (k[31] & 127) | 64
+
+	return k, nil
+}
+
+// ParseKey parses a base64-encoded key.
+func ParseKey(s string) (Key, error) {
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return Key{}, fmt.Errorf("invalid key: %w", err)
+	}
+
+	var k Key
+	if len(b) != len(k) {
+		return Key{}, fmt.Errorf("invalid key: %d bytes, want %d", len(b), len(k))
+	}
+
+	copy(k[:], b)
+	return k, nil
+}
+
+// String returns the base64 encoding of the key, which is how WireGuard
+// configuration files give keys.
+func (k Key) String() string {
+	return base64.StdEncoding.EncodeToString(k[:])
+}
+
+// PublicKey returns the public key of the private key k.
+func (k Key) PublicKey() (Key, error) {
+	b, err := curve25519.X25519(k[:], curve25519.Basepoint)
+	if err != nil {
+		return Key{}, err
+	}
+
+	var pub Key
+	copy(pub[:], b)
+	return pub, nil
+}
+
+// LoadKey loads the private key at path, generating it if the file
+// doesn't exist.
+func LoadKey(path string) (Key, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		k, err := GenerateKey()
+		if err != nil {
+			return Key{}, err
+		}
+
+		if err := ioutil.WriteFile(path, []byte(k.String()+"\n"), 0600); err != nil {
+			return Key{}, err
+		}
+
+		return k, nil
+	}
+
+	if err != nil {
+		return Key{}, err
+	}
+
+	k, err := ParseKey(string(b))
+	if err != nil {
+		return Key{}, fmt.Errorf("failed to parse %q: %w", path, err)
+	}
+
+	return k, nil
+}
+
+// Interface is the local side of a wg-quick(8) configuration.
+type Interface struct {
+	PrivateKey Key
+	Address    string
+	ListenPort int
+	PostUp     []string
+	PostDown   []string
+}
+
+// Peer is a remote side of a wg-quick(8) configuration.
+type Peer struct {
+	PublicKey           Key
+	AllowedIPs          []string
+	Endpoint            string
+	PersistentKeepalive int
+}
+
+// Config is a wg-quick(8) configuration file.
+type Config struct {
+	Interface Interface
+	Peers     []Peer
+}
+
+// Render renders the configuration file.
+func (c *Config) Render() string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "[Interface]\n")
+	fmt.Fprintf(&b, "PrivateKey = %s\n", c.Interface.PrivateKey)
+	fmt.Fprintf(&b, "Address = %s\n", c.Interface.Address)
+
+	if c.Interface.ListenPort != 0 {
+		fmt.Fprintf(&b, "ListenPort = %d\n", c.Interface.ListenPort)
+	}
+
+	for _, cmd := range c.Interface.PostUp {
+		fmt.Fprintf(&b, "PostUp = %s\n", cmd)
+	}
+
+	for _, cmd := range c.Interface.PostDown {
+		fmt.Fprintf(&b, "PostDown = %s\n", cmd)
+	}
+
+	for _, p := range c.Peers {
+		fmt.Fprintf(&b, "\n[Peer]\n")
+		fmt.Fprintf(&b, "PublicKey = %s\n", p.PublicKey)
+		fmt.Fprintf(&b, "AllowedIPs = %s\n", strings.Join(p.AllowedIPs, ", "))
+
+		if p.Endpoint != "" {
+			fmt.Fprintf(&b, "Endpoint = %s\n", p.Endpoint)
+		}
+
+		if p.PersistentKeepalive != 0 {
+			fmt.Fprintf(&b, "PersistentKeepalive = %d\n", p.PersistentKeepalive)
+		}
+	}
+
+	return b.String()
+}
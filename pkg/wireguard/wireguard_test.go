@@ -0,0 +1,157 @@
+package wireguard
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// The key pairs from RFC 7748, section 6.1. "wg pubkey" prints the
+// public key for each private key.
+var testKeys = []struct {
+	private string
+	public  string
+}{
+	{"dwdtCnMYpX08FsFyUbJmRd9ML4frwJkqsXf7pR25LCo=", "hSDwCYkwp1R0i33ctD73Wg2/Og0mOBr066SpjqqbTmo="},
+	{"XasIfmJKikt54X+Lg4AO5m87sSkmGLb9HC+LJ/+I4Os=", "3p7bfXt9wbTTW2HC7OQ1Nz+DQ8hbeGdNrfx+FG+IK08="},
+}
+
+func TestPublicKey(t *testing.T) {
+	for _, tt := range testKeys {
+		priv, err := ParseKey(tt.private)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if priv.String() != tt.private {
+			t.Errorf("got %s, want %s", priv, tt.private)
+		}
+
+		pub, err := priv.PublicKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if pub.String() != tt.public {
+			t.Errorf("got public key %s, want %s", pub, tt.public)
+		}
+	}
+}
+
+func TestGenerateKey(t *testing.T) {
+	k, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The key is clamped, like "wg genkey" does.
+	if k[0]&7 != 0 || k[31]&128 != 0 || k[31]&64 == 0 {
+		t.Errorf("key %x is not clamped", k)
+	}
+
+	if other, _ := GenerateKey(); other == k {
+		t.Errorf("generated the same key twice")
+	}
+}
+
+func TestParseKey(t *testing.T) {
+	if k, err := ParseKey(" " + testKeys[0].private + "\n"); err != nil || k.String() != testKeys[0].private {
+		t.Errorf("got %s, %v with surrounding space", k, err)
+	}
+
+	for _, s := range []string{
+		"",
+		"not base64!",
+		"dwdtCnMYpX08FsFyUbJmRd9ML4frwJkqsXf7pR25LA==",
+		"dwdtCnMYpX08FsFyUbJmRd9ML4frwJkqsXf7pR25LCoA",
+	} {
+		if k, err := ParseKey(s); err == nil {
+			t.Errorf("%q: parsed %s, want an error", s, k)
+		}
+	}
+}
+
+func TestLoadKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wireguard.key")
+
+	generated, err := LoadKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(b) != generated.String()+"\n" {
+		t.Errorf("wrote %q, want %q", b, generated.String()+"\n")
+	}
+
+	loaded, err := LoadKey(path)
+	if err != nil || loaded != generated {
+		t.Errorf("got %s, %v, want the generated key", loaded, err)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("garbage\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := LoadKey(path); err == nil || !strings.Contains(err.Error(), path) {
+		t.Errorf("got %v, want a parse error", err)
+	}
+}
+
+func TestRender(t *testing.T) {
+	priv, _ := ParseKey(testKeys[0].private)
+	peer, _ := ParseKey(testKeys[1].public)
+
+	c := &Config{
+		Interface: Interface{
+			PrivateKey: priv,
+			Address:    "10.99.0.1/24",
+			ListenPort: 51820,
+			PostUp:     []string{"sysctl -w net.ipv4.ip_forward=1", "iptables -A FORWARD -i %i -j ACCEPT"},
+			PostDown:   []string{"iptables -D FORWARD -i %i -j ACCEPT"},
+		},
+		Peers: []Peer{{
+			PublicKey:           peer,
+			AllowedIPs:          []string{"10.99.0.2/32", "172.16.0.0/16"},
+			Endpoint:            "203.0.113.1:51820",
+			PersistentKeepalive: 25,
+		}, {
+			PublicKey:  peer,
+			AllowedIPs: []string{"10.99.0.3/32"},
+		}},
+	}
+
+	want := `[Interface]
+PrivateKey = dwdtCnMYpX08FsFyUbJmRd9ML4frwJkqsXf7pR25LCo=
+Address = 10.99.0.1/24
+ListenPort = 51820
+PostUp = sysctl -w net.ipv4.ip_forward=1
+PostUp = iptables -A FORWARD -i %i -j ACCEPT
+PostDown = iptables -D FORWARD -i %i -j ACCEPT
+
+[Peer]
+PublicKey = 3p7bfXt9wbTTW2HC7OQ1Nz+DQ8hbeGdNrfx+FG+IK08=
+AllowedIPs = 10.99.0.2/32, 172.16.0.0/16
+Endpoint = 203.0.113.1:51820
+PersistentKeepalive = 25
+
+[Peer]
+PublicKey = 3p7bfXt9wbTTW2HC7OQ1Nz+DQ8hbeGdNrfx+FG+IK08=
+AllowedIPs = 10.99.0.3/32
+`
+
+	if got := c.Render(); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+
+	// The optional settings are left out.
+	c = &Config{Interface: Interface{PrivateKey: priv, Address: "10.99.0.2/32"}}
+	if got := c.Render(); got != "[Interface]\nPrivateKey = "+testKeys[0].private+"\nAddress = 10.99.0.2/32\n" {
+		t.Errorf("got\n%s", got)
+	}
+}